@@ -0,0 +1,134 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import "math"
+
+func NewADSR() *ADSR {
+	a := &ADSR{}
+	a.inputs("gate", &a.gate, "trig", &a.trig, "att", &a.att, "dec", &a.dec,
+		"sus", &a.sus, "rel", &a.rel, "curve", &a.curve)
+	return a
+}
+
+// ADSR is an attack/decay/sustain/release envelope.
+//
+// The envelope attacks when its gate input rises above 0.5, or when its
+// trig input fires, rising from its current level to 1 over att seconds.
+// It then decays to the sus level over dec seconds, and holds there while
+// the gate stays high. When the gate falls, the envelope releases to 0
+// over rel seconds. If the gate is already low when an attack completes,
+// as when it is triggered without a gate, the release follows at once.
+//
+// The curve input shapes each stage: 0 is linear, 1 is exponential,
+// rising or falling quickly at first and settling slowly like an analog
+// envelope, and -1 is logarithmic, starting slowly and finishing quickly.
+type ADSR struct {
+	sink
+	gate                      Processor
+	trig                      trigger
+	att, dec, sus, rel, curve source
+
+	stage adsrStage
+	held  bool    // Whether the gate is high.
+	p     float64 // Progress through the current stage, from 0 to 1.
+	start Sample  // Level at the start of the current stage.
+	v     Sample
+}
+
+type adsrStage int
+
+const (
+	adsrIdle adsrStage = iota
+	adsrAttack
+	adsrDecay
+	adsrSustain
+	adsrRelease
+)
+
+// adsrSteepness is the steepness of the curves selected by
+// a curve input of 1 or -1.
+const adsrSteepness = 5
+
+func (a *ADSR) Process(s []Sample) {
+	a.gate.Process(s)
+	att, dec, sus, rel, curve, t := a.att.Process(), a.dec.Process(),
+		a.sus.Process(), a.rel.Process(), a.curve.Process(), a.trig.Process()
+	rate := float64(a.c.SampleRate)
+	for i := range s {
+		held := s[i] > triggerThreshold
+		if trig := a.trig.isTrigger(t[i]); trig || held && !a.held {
+			a.begin(adsrAttack)
+		} else if !held && a.held && a.stage != adsrIdle {
+			a.begin(adsrRelease)
+		}
+		a.held = held
+
+		c := float64(curve[i])
+		switch a.stage {
+		case adsrAttack:
+			a.v = a.ramp(att[i], 1, c, rate)
+			if a.p >= 1 {
+				if held {
+					a.begin(adsrDecay)
+				} else {
+					a.begin(adsrRelease)
+				}
+			}
+		case adsrDecay:
+			a.v = a.ramp(dec[i], sus[i], c, rate)
+			if a.p >= 1 {
+				a.stage = adsrSustain
+			}
+		case adsrSustain:
+			a.v = sus[i]
+		case adsrRelease:
+			a.v = a.ramp(rel[i], 0, c, rate)
+			if a.p >= 1 {
+				a.stage = adsrIdle
+			}
+		}
+		s[i] = a.v
+	}
+}
+
+// begin starts the given stage from the current level.
+func (a *ADSR) begin(stage adsrStage) {
+	a.stage, a.start, a.p = stage, a.v, 0
+}
+
+// ramp advances through the current stage, which lasts d seconds,
+// and returns the level on the way from the start of the stage to target.
+func (a *ADSR) ramp(d, target Sample, curve, rate float64) Sample {
+	if d > 0 {
+		a.p += 1 / (float64(d) * rate)
+	}
+	if d <= 0 || a.p > 1 {
+		a.p = 1
+	}
+	return a.start + (target-a.start)*Sample(adsrShape(a.p, curve))
+}
+
+// adsrShape maps progress p through a stage onto the given curve.
+// Both p and the result run from 0 to 1.
+func adsrShape(p, curve float64) float64 {
+	k := curve * adsrSteepness
+	if math.Abs(k) < 1e-3 {
+		return p
+	}
+	return (1 - math.Exp(-k*p)) / (1 - math.Exp(-k))
+}
@@ -16,7 +16,19 @@ limitations under the License.
 
 package audio
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nf/sigourney/wav"
+)
 
 func BenchmarkSin(b *testing.B) {
 	b.StopTimer()
@@ -62,6 +74,820 @@ func TestDelay(t *testing.T) {
 	}
 }
 
+// impulse is a Processor whose output is a single 1 followed by silence.
+type impulse struct{ done bool }
+
+func (p *impulse) Process(s []Sample) {
+	for i := range s {
+		s[i] = 0
+	}
+	if !p.done {
+		s[0], p.done = 1, true
+	}
+}
+
+func TestDelayLine(t *testing.T) {
+	const rate = 1000
+	// run returns the first n samples of the output of a DelayLine,
+	// with a maximum delay of ten seconds and the given inputs,
+	// given an impulse.
+	run := func(n int, inputs map[string]Sample) []Sample {
+		d := NewDelayLine()
+		d.Configure(Config{SampleRate: rate, FrameLength: 100})
+		d.SetMaxDelay(10)()
+		d.Input("in", &impulse{})
+		for name, v := range inputs {
+			d.Input(name, Value(v))
+		}
+		var out []Sample
+		b := make([]Sample, 100)
+		for len(out) < n {
+			d.Process(b)
+			out = append(out, b...)
+		}
+		return out
+	}
+	near := func(a, b Sample) bool { return math.Abs(float64(a-b)) < 1e-9 }
+
+	// Echoes decay by the feedback gain.
+	out := run(100, map[string]Sample{"len": 0.01, "fb": 0.5})
+	for i, v := range out {
+		want := Sample(0)
+		if i > 0 && i%10 == 0 {
+			want = Sample(math.Pow(0.5, float64(i/10-1)))
+		}
+		if !near(v, want) {
+			t.Fatalf("feedback: sample %v == %v, want %v", i, v, want)
+		}
+	}
+
+	// Fractional delays are interpolated.
+	for _, c := range []struct {
+		interp Sample
+		len    Sample
+		at     int
+		want   []Sample
+	}{
+		{0, 0.0105, 10, []Sample{0.5, 0.5}},
+		{0.1, 0.0105, 10, []Sample{1.0 / 3, 1 - 1.0/9}},
+		{0.2, 0.0105, 9, []Sample{-0.0625, 0.5625, 0.5625, -0.0625}},
+		{0.2, 3.0005, 2999, []Sample{-0.0625, 0.5625, 0.5625, -0.0625}},
+	} {
+		out := run(c.at+len(c.want)+1, map[string]Sample{"len": c.len, "interp": c.interp})
+		for i, want := range c.want {
+			if v := out[c.at+i]; !near(v, want) {
+				t.Errorf("interp %v, len %v: sample %v == %v, want %v", c.interp, c.len, c.at+i, v, want)
+			}
+		}
+	}
+
+	// Delays are limited to the maximum, and raising the maximum
+	// keeps the samples the buffer holds.
+	d := NewDelayLine()
+	d.SetMaxDelay(1)()
+	d.Configure(Config{SampleRate: rate, FrameLength: 100})
+	d.Input("in", &impulse{})
+	d.Input("len", Value(2))
+	b := make([]Sample, 100)
+	for i := 0; i <= 1000; i += 100 {
+		d.Process(b)
+	}
+	if b[0] != 1 {
+		t.Errorf("at maximum: sample 1000 == %v, want 1", b[0])
+	}
+	d = NewDelayLine()
+	d.SetMaxDelay(1)()
+	d.Configure(Config{SampleRate: rate, FrameLength: 100})
+	d.Input("in", &impulse{})
+	d.Input("len", Value(2))
+	d.Process(b)
+	d.SetMaxDelay(3)()
+	for i := 100; i <= 2000; i += 100 {
+		d.Process(b)
+	}
+	if b[0] != 1 {
+		t.Errorf("after raising maximum: sample 2000 == %v, want 1", b[0])
+	}
+
+	// Process doesn't allocate.
+	d = NewDelayLine()
+	d.Configure(Config{SampleRate: rate, FrameLength: 100})
+	d.Input("len", Value(9))
+	if n := testing.AllocsPerRun(10, func() { d.Process(b) }); n != 0 {
+		t.Errorf("Process made %v allocations", n)
+	}
+	if n := testing.AllocsPerRun(10, d.SetMaxDelay(2)); n != 0 {
+		t.Errorf("SetMaxDelay's function made %v allocations", n)
+	}
+
+	// The dry input passes the input through.
+	if out := run(1, map[string]Sample{"len": 0.01, "dry": 1}); out[0] != 1 {
+		t.Errorf("dry: sample 0 == %v, want 1", out[0])
+	}
+}
+
+func TestReverb(t *testing.T) {
+	// run returns two seconds of the response of a Reverb
+	// with the given inputs to an impulse.
+	run := func(inputs map[string]Sample) []Sample {
+		r := NewReverb()
+		r.Input("in", &impulse{})
+		for name, v := range inputs {
+			r.Input(name, Value(v))
+		}
+		var out []Sample
+		b := make([]Sample, FrameLength)
+		for len(out) < 2*waveHz {
+			r.Process(b)
+			out = append(out, b...)
+		}
+		return out
+	}
+	// energy returns the energy of the given second of s.
+	energy := func(s []Sample, second int) (e float64) {
+		for _, v := range s[second*waveHz : (second+1)*waveHz] {
+			e += float64(v * v)
+		}
+		return e
+	}
+
+	if out := run(map[string]Sample{"size": 0.5}); out[0] != 1 || energy(out, 1) != 0 {
+		t.Errorf("with mix 0, output isn't the input")
+	}
+
+	// The reverberation starts after the pre-delay
+	// and the shortest comb filter.
+	out := run(map[string]Sample{"size": 0.5, "pre": 0.1, "mix": 1})
+	start := waveHz/10 + reverbCombs[0]
+	for i, v := range out[:start] {
+		if v != 0 {
+			t.Fatalf("sample %v == %v before the reverberation starts", i, v)
+		}
+	}
+	if out[start] == 0 {
+		t.Errorf("sample %v == 0, want the start of the reverberation", start)
+	}
+
+	// Larger rooms reverberate longer.
+	small := energy(run(map[string]Sample{"size": 0.1, "mix": 1}), 1)
+	large := energy(run(map[string]Sample{"size": 0.9, "mix": 1}), 1)
+	if !(small < large) {
+		t.Errorf("energy in second second: size 0.1 == %v, size 0.9 == %v", small, large)
+	}
+
+	r := NewReverb()
+	r.Input("in", NewSin())
+	r.Input("size", NewSin())
+	b := make([]Sample, FrameLength)
+	if n := testing.AllocsPerRun(10, func() { r.Process(b) }); n != 0 {
+		t.Errorf("Process made %v allocations, want 0", n)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigourney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { SampleDir = d }(SampleDir)
+	SampleDir = dir
+
+	// A stereo ramp at half the engine's rate,
+	// which mixes down to 0, 0.001, 0.002, ...
+	f, err := os.Create(filepath.Join(dir, "ramp.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := wav.NewEncoder(f, wav.Float32, waveHz/2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := enc.Write([]float64{float64(i) / 500, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	snd, err := LoadSound("ramp.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snd.Len() != n || snd.Rate != waveHz/2 {
+		t.Fatalf("loaded %d samples at %dHz, want %d at %dHz", snd.Len(), snd.Rate, n, waveHz/2)
+	}
+	for _, name := range []string{"", "../ramp.wav", dir + "/ramp.wav", "missing.wav"} {
+		if _, err := LoadSound(name); err == nil {
+			t.Errorf("LoadSound(%q) succeeded", name)
+		}
+	}
+
+	near := func(a, b Sample) bool { return math.Abs(float64(a-b)) < 1e-6 }
+	buf := make([]Sample, FrameLength)
+	s := NewSampler()
+	s.SetSound(snd)
+	s.Process(buf)
+	for i, v := range buf {
+		if v != 0 {
+			t.Fatalf("sample %d is %v before a trigger, want 0", i, v)
+		}
+	}
+
+	// Each sample of the sound lasts two at the engine's rate,
+	// and playback stops at the end.
+	s.Input("trig", Value(1))
+	s.Process(buf)
+	for i, v := range buf {
+		want := Sample(i) / 2000
+		if i >= 2*n {
+			want = 0
+		} else if i < 2 || i >= 2*n-4 {
+			continue // Interpolated against the silence around the sound.
+		}
+		if !near(v, want) {
+			t.Fatalf("sample %d is %v, want %v", i, v, want)
+		}
+	}
+
+	// Up an octave, from half way through.
+	s.Input("trig", Value(0))
+	s.Process(buf)
+	s.Input("trig", Value(1))
+	s.Input("pitch", Value(0.1))
+	s.Input("start", Value(0.5))
+	s.Process(buf)
+	if !near(buf[10], 0.06) || buf[n/2] != 0 {
+		t.Errorf("transposed sound from half way gave %v and %v, want 0.06 and 0", buf[10], buf[n/2])
+	}
+
+	// Looping repeats the part between start and end.
+	s.Input("trig", Value(0))
+	s.Process(buf)
+	s.Input("trig", Value(1))
+	s.Input("end", Value(0.6))
+	s.Input("loop", Value(1))
+	for i := 0; i < 3; i++ {
+		s.Process(buf)
+	}
+	for i, v := range buf {
+		if v < 0.0495 || v > 0.0605 {
+			t.Fatalf("looped sample %d is %v, want 0.05 to 0.06", i, v)
+		}
+	}
+
+	if n := testing.AllocsPerRun(10, func() { s.Process(buf) }); n != 0 {
+		t.Errorf("Process allocated %v times", n)
+	}
+}
+
+func TestEngineChannels(t *testing.T) {
+	e := NewEngine(Channels(2))
+	in := make(map[string]bool)
+	for _, name := range e.Inputs() {
+		in[name] = true
+	}
+	if !in["in0"] || !in["in1"] || in["in"] {
+		t.Fatalf("Inputs() == %v, want in0 and in1", e.Inputs())
+	}
+
+	// A lone first channel is sent to both outputs.
+	e.Input("in", Value(0.5))
+	b := e.Process()
+	if len(b) != 2*FrameLength {
+		t.Fatalf("len(b) == %v, want %v", len(b), 2*FrameLength)
+	}
+	if b[0] != 0.5 || b[1] != 0.5 {
+		t.Errorf("mono: b[0:2] == %v, want [0.5 0.5]", b[0:2])
+	}
+
+	// Otherwise the channels are interleaved.
+	e.Input("in1", Value(-0.25))
+	b = e.Process()
+	if b[0] != 0.5 || b[1] != -0.25 || b[2] != 0.5 || b[3] != -0.25 {
+		t.Errorf("stereo: b[0:4] == %v, want [0.5 -0.25 0.5 -0.25]", b[0:4])
+	}
+}
+
+func TestCrossfade(t *testing.T) {
+	const n = 3 * FrameLength / 2 // Fade over one and a half frames.
+	e := NewEngine(SampleRate(n))
+	e.Input("in", Value(1))
+	e.Process()
+
+	e.Do(e.Crossfade(time.Second, 0), func() { e.Input("in", Value(-1)) })
+	var out []Sample
+	for i := 0; i < 3; i++ {
+		out = append(out, e.Process()...)
+	}
+	for i, v := range out {
+		want := Sample(-1)
+		if i < n {
+			g := Sample(i) / n
+			want = 1 - 2*g
+		}
+		if math.Abs(float64(v-want)) > 1e-6 {
+			t.Fatalf("sample %v == %v, want %v", i, v, want)
+		}
+	}
+	if e.fade != nil {
+		t.Error("fade still in progress after it completed")
+	}
+
+	// Starting a fade doesn't allocate, given the number of Tickers.
+	e.AddTicker(NewDup(Value(1)))
+	e.AddTicker(NewDup(Value(2)))
+	if n := testing.AllocsPerRun(10, e.Crossfade(time.Second, 2)); n != 0 {
+		t.Errorf("starting a fade made %v allocations", n)
+	}
+}
+
+func TestADSR(t *testing.T) {
+	// Stages of 32 and 64 samples, so that each ends on an exact sample.
+	const rate = 1024
+	a := NewADSR()
+	a.Configure(Config{SampleRate: rate, FrameLength: 128})
+	a.Input("att", Value(32.0/rate))
+	a.Input("dec", Value(32.0/rate))
+	a.Input("sus", Value(0.5))
+	a.Input("rel", Value(64.0/rate))
+	b := make([]Sample, 128)
+	check := func(stage string, want map[int]Sample) {
+		a.Process(b)
+		for i, v := range want {
+			if b[i] != v {
+				t.Errorf("%v: sample %v == %v, want %v", stage, i, b[i], v)
+			}
+		}
+	}
+
+	a.Input("gate", Value(1))
+	check("attack", map[int]Sample{0: 1.0 / 32, 15: 0.5, 31: 1, 47: 0.75, 63: 0.5, 127: 0.5})
+	a.Input("gate", Value(0))
+	check("release", map[int]Sample{0: 0.5 - 0.5/64, 31: 0.25, 63: 0, 127: 0})
+
+	// A trigger without a gate attacks and then releases.
+	a.Input("trig", Value(1))
+	check("trigger", map[int]Sample{31: 1, 63: 0.5, 95: 0, 127: 0})
+
+	for _, c := range []struct{ curve, lo, hi float64 }{
+		{0, 0.5, 0.5},
+		{1, 0.9, 1},
+		{-1, 0, 0.1},
+	} {
+		if v := adsrShape(0.5, c.curve); v < c.lo || v > c.hi {
+			t.Errorf("curve %v: halfway == %v, want %v to %v", c.curve, v, c.lo, c.hi)
+		}
+		if v := adsrShape(1, c.curve); math.Abs(v-1) > 1e-12 {
+			t.Errorf("curve %v: end == %v, want 1", c.curve, v)
+		}
+	}
+}
+
+func TestSinSampleRate(t *testing.T) {
+	// A one second render of a 440Hz sine wave should contain
+	// 440 rising zero crossings regardless of sample rate.
+	for _, c := range []Config{
+		{SampleRate: 44100, FrameLength: 256},
+		{SampleRate: 48000, FrameLength: 64},
+		{SampleRate: 96000, FrameLength: 1000},
+	} {
+		o := NewSin()
+		o.Configure(c)
+		b := make([]Sample, c.FrameLength)
+		n, last := 0, Sample(0)
+		for i := 0; i < c.SampleRate; i += c.FrameLength {
+			o.Process(b)
+			for _, v := range b {
+				if last < 0 && v >= 0 {
+					n++
+				}
+				last = v
+			}
+		}
+		if n < 439 || n > 441 {
+			t.Errorf("%+v: %d crossings, want 440", c, n)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var loud Value = 4
+	e := NewEngine(Lookahead(time.Millisecond))
+	e.Input("in", &loud)
+	e.Input("rel", Value(0.01))
+	peak := func(b []Sample) (p Sample) {
+		for _, v := range b {
+			if v < 0 {
+				v = -v
+			}
+			if v > p {
+				p = v
+			}
+		}
+		return
+	}
+
+	// Loud input is held to the ceiling.
+	if p := peak(e.Render(20)); p > 1 {
+		t.Errorf("loud: peak == %v, want <= 1", p)
+	}
+
+	// Once the input is quiet again the gain recovers.
+	loud = 0.5
+	b := e.Render(40)
+	if p := peak(b[len(b)-FrameLength:]); p < 0.49 {
+		t.Errorf("quiet: peak == %v, want 0.5", p)
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	c := NewCompressor()
+	c.Input("in", Value(1))
+	c.Input("thresh", Value(-0.2)) // -20dB
+	c.Input("ratio", Value(2))
+	b := make([]Sample, FrameLength)
+	c.Process(b)
+	// 20dB over the threshold at 2:1 leaves the output 10dB over it.
+	if want := Sample(math.Pow(10, -10.0/20)); math.Abs(float64(b[0]-want)) > 1e-9 {
+		t.Errorf("b[0] == %v, want %v", b[0], want)
+	}
+}
+
+func TestEngineDo(t *testing.T) {
+	e := NewEngine()
+	var got []int
+	e.Do(func() { got = append(got, 1) }, func() { got = append(got, 2) })
+	e.Do(func() { got = append(got, 3) })
+	if len(got) != 0 {
+		t.Fatalf("functions ran before Process: %v", got)
+	}
+	e.Process()
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("got %v, want [1 2 3]", got)
+	}
+
+	// Mutate the graph from another goroutine while it is processed.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			v := Value(i)
+			e.Do(func() { e.Input("in", v) })
+		}
+		e.Do(func() { e.Input("in", Value(-1)) })
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if b := e.Process(); b[0] != -1 {
+				t.Errorf("b[0] == %v, want -1", b[0])
+			}
+			return
+		default:
+			e.Process()
+		}
+	}
+}
+
+// fmEngine builds an Engine that plays the sum of n frequency-modulated
+// sine waves through a delay with feedback, and installs a schedule for
+// its workers.
+func fmEngine(n int, opts ...Option) *Engine {
+	e := NewEngine(opts...)
+	g := NewGraph()
+	dup := func(p Processor, deps ...*Dup) *Dup {
+		if c, ok := p.(Configurer); ok {
+			c.Configure(e.Config())
+		}
+		d := NewDup(p)
+		e.AddTicker(d)
+		g.Add(d, deps...)
+		return d
+	}
+	var sums []*Dup
+	for i := 0; i < n; i++ {
+		mod := NewSin()
+		mod.Input("pitch", Value(-0.2+Sample(i)*0.01))
+		modD := dup(mod)
+		car := NewSin()
+		car.Input("pitch", modD.Output())
+		sums = append(sums, dup(car, modD))
+	}
+	for len(sums) > 1 {
+		a, b := sums[0], sums[1]
+		s := NewSum()
+		s.Input("a", a.Output())
+		s.Input("b", b.Output())
+		sums = append(sums[2:], dup(s, a, b))
+	}
+	sum := sums[0]
+	mix, dly := NewSum(), NewDelay()
+	mixD := dup(mix)
+	dlyD := dup(dly, mixD)
+	mix.Input("a", sum.Output())
+	mix.Input("b", dlyD.Output())
+	g.Add(mixD, sum, dlyD)
+	dly.Input("in", mixD.Output())
+	dly.Input("len", Value(0.001))
+	e.Input("in", mixD.Output())
+	g.Root(mixD)
+	e.Plan(g)()
+	return e
+}
+
+func TestEngineWorkers(t *testing.T) {
+	serial, parallel := fmEngine(8), fmEngine(8, Workers(4))
+	if parallel.plan == nil || len(parallel.plan.levels) == 0 {
+		t.Fatal("no parallel schedule")
+	}
+	for _, l := range parallel.plan.levels {
+		for _, d := range l {
+			if _, ok := d.src.(*Delay); ok {
+				t.Fatal("feedback loop scheduled for parallel processing")
+			}
+		}
+	}
+	defer parallel.stopWorkers()
+	for f := 0; f < 100; f++ {
+		a, b := serial.Process(), parallel.Process()
+		for i := range a {
+			if a[i] != b[i] {
+				t.Fatalf("frame %d sample %d: serial %v, parallel %v", f, i, a[i], b[i])
+			}
+		}
+	}
+
+	// Render must not leave the workers running on a stopped Engine.
+	parallel.Render(10)
+	if parallel.work != nil {
+		t.Error("workers still running after Render")
+	}
+}
+
+func benchmarkEngine(b *testing.B, workers int) {
+	e := fmEngine(64, Workers(workers))
+	defer e.stopWorkers()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Process()
+	}
+}
+
+func BenchmarkEngineSerial(b *testing.B)   { benchmarkEngine(b, 1) }
+func BenchmarkEngineParallel(b *testing.B) { benchmarkEngine(b, 4) }
+
+// failingWriter accepts n writes, and then fails.
+type failingWriter struct {
+	n   int
+	buf []byte
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errWriterFull
+	}
+	w.n--
+	w.buf = append(w.buf, b...)
+	return len(b), nil
+}
+
+func TestBackends(t *testing.T) {
+	f, err := ioutil.TempFile("", "sigourney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// The file backend writes a WAV file of the engine's output.
+	e := NewEngine(Channels(2), SampleRate(8000))
+	e.Input("in0", Value(0.5))
+	e.Input("in1", Value(-0.25))
+	e.SetBackend(NewFileBackend(f.Name(), wav.Float32))
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := wav.Decode(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Format != wav.Float32 || d.Rate != 8000 || d.Channels != 2 {
+		t.Errorf("wrote %v at %vHz with %v channels, want float32 at 8000Hz with 2", d.Format, d.Rate, d.Channels)
+	}
+	n := len(d.Samples)
+	if n == 0 || n%(2*FrameLength) != 0 {
+		t.Fatalf("wrote %v samples, want a positive number of whole frames", n)
+	}
+	if l, r := d.Samples[n-2], d.Samples[n-1]; l != 0.5 || r != -0.25 {
+		t.Errorf("last frame ends with %v, %v; want 0.5, -0.25", l, r)
+	}
+
+	// The raw backend writes frames as fast as it can,
+	// and Stop reports the error that stopped it.
+	w := &failingWriter{n: 3}
+	e = NewEngine()
+	e.Input("in", Value(0.5))
+	e.SetBackend(NewRawBackend(w, wav.PCM16))
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := e.Stop(); err != errWriterFull {
+		t.Errorf("Stop returned %v, want %v", err, errWriterFull)
+	}
+	if len(w.buf) != 3*2*FrameLength {
+		t.Errorf("raw backend wrote %d bytes, want %d", len(w.buf), 3*2*FrameLength)
+	}
+
+	// The null backend pulls frames from the engine.
+	c := new(countingProcessor)
+	e = NewEngine()
+	e.Input("in", c)
+	e.SetBackend(NewNullBackend())
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if *c == 0 {
+		t.Error("null backend pulled no frames")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "sigourney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	e := NewEngine()
+	e.Input("in", Value(0.5))
+	r, err := e.Record(f.Name(), wav.Float32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := e.Render(10)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	e.Render(1) // Not recorded.
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, v := range want {
+		data = wav.Float32.Append(data, float64(v))
+	}
+	if len(b) != 44+len(data) || string(b[44:]) != string(data) {
+		t.Errorf("recorded %d bytes, want %d bytes of rendered output", len(b), 44+len(data))
+	}
+	if n := r.Dropped(); n != 0 {
+		t.Errorf("dropped %d frames", n)
+	}
+
+	// Record from a running Engine.
+	e.SetBackend(NewNullBackend())
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = e.Record(f.Name(), wav.PCM16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(f.Name()); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() <= 44 {
+		t.Errorf("recorded %d bytes from running Engine", fi.Size())
+	}
+
+	// Close doesn't hang when the Backend has stopped pulling frames.
+	defer func(d time.Duration) { recordCloseTimeout = d }(recordCloseTimeout)
+	recordCloseTimeout = 10 * time.Millisecond
+	w := &failingWriter{n: 1}
+	e.SetBackend(NewRawBackend(w, wav.PCM16))
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	r, err = e.Record(f.Name(), wav.PCM16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error)
+	go func() { closed <- r.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hung after the Backend stopped")
+	}
+}
+
+// unregister removes a kind registered by a test.
+func unregister(name string) {
+	kindsMu.Lock()
+	delete(kinds, name)
+	kindsMu.Unlock()
+}
+
+func TestRegister(t *testing.T) {
+	Register("test", func() Processor { return Value(1) }, KindInfo{Doc: "test kind"})
+	defer unregister("test")
+	p, err := NewKind("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := p.(Value); !ok || v != 1 {
+		t.Errorf("NewKind returned %v, want Value(1)", p)
+	}
+	if info, ok := LookupKind("test"); !ok || info.Doc != "test kind" {
+		t.Errorf("LookupKind returned %v, %v", info, ok)
+	}
+	found := false
+	for _, k := range Kinds() {
+		found = found || k == "test"
+	}
+	if !found {
+		t.Error("Kinds does not include test")
+	}
+	if _, err := NewKind("bogus"); err == nil {
+		t.Error("NewKind of unknown kind succeeded")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate Register did not panic")
+		}
+	}()
+	Register("sin", func() Processor { return NewSin() }, KindInfo{})
+}
+
+func TestKindInfo(t *testing.T) {
+	check := func(kind string, p interface{}, info KindInfo) {
+		var inputs []string
+		if s, ok := p.(Sink); ok {
+			inputs = s.Inputs()
+		}
+		described := make(map[string]bool)
+		for _, name := range inputs {
+			if _, ok := info.Input(name); !ok {
+				t.Errorf("%v: no description of input %q", kind, name)
+			}
+			described[strings.Trim(name, "0123456789")] = true
+		}
+		for name, in := range info.Inputs {
+			if !described[name] {
+				t.Errorf("%v: description of unknown input %q", kind, name)
+			}
+			if err := in.Check(in.Default); err != nil {
+				t.Errorf("%v: default of input %q: %v", kind, name, err)
+			}
+		}
+	}
+	for _, k := range Kinds() {
+		p, err := NewKind(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := LookupKind(k)
+		check(k, p, info)
+	}
+	for _, n := range []int{1, 2} {
+		e := NewEngine(Channels(n))
+		check("engine", e, e.KindInfo())
+	}
+}
+
 func TestDup(t *testing.T) {
 	var p countingProcessor
 	d := NewDup(&p)
@@ -156,6 +982,126 @@ func TestDup(t *testing.T) {
 	check()
 }
 
+func TestDupOutputs(t *testing.T) {
+	s := NewStep()
+	s.Input("trig", Value(1))
+	for i := 0; i < DefaultSteps; i++ {
+		s.Input(fmt.Sprintf("v%d", i), Value(Sample(i)/10))
+	}
+	d := NewDup(s)
+	out, gate := d.Output(), d.OutputN(1)
+
+	b := make([]Sample, FrameLength)
+	d.Tick()
+	gate.Process(b)
+	if b[0] != 1 {
+		t.Errorf("gate: b[0] == %v, want 1", b[0])
+	}
+	out.Process(b)
+	if b[0] != 0.1 {
+		t.Errorf("out: b[0] == %v, want 0.1", b[0])
+	}
+}
+
+// pulse is a Processor whose output is 1 on every other sample.
+type pulse struct{ n int }
+
+func (p *pulse) Process(s []Sample) {
+	for i := range s {
+		s[i] = Sample((p.n + 1) % 2)
+		p.n++
+	}
+}
+
+func TestStep(t *testing.T) {
+	// play returns the steps played on the first n triggers, and the
+	// gate output on each, of a sequencer with the given number of steps.
+	play := func(steps, n int, inputs ...interface{}) (got []int, gate []bool) {
+		s := NewStep()
+		s.SetSteps(steps)
+		for i := 0; i < steps; i++ {
+			s.Input(fmt.Sprint("v", i), Value(Sample(i)/100))
+		}
+		s.Input("trig", &pulse{})
+		for i := 0; i < len(inputs); i += 2 {
+			s.Input(inputs[i].(string), Value(inputs[i+1].(float64)))
+		}
+		b := [][]Sample{make([]Sample, FrameLength), make([]Sample, FrameLength)}
+		for len(got) < n {
+			s.ProcessMulti(b)
+			for i := 0; i < FrameLength && len(got) < n; i += 2 {
+				got = append(got, int(b[0][i]*100+0.5))
+				gate = append(gate, b[1][i] == 1)
+			}
+		}
+		return got, gate
+	}
+	for _, c := range []struct {
+		desc   string
+		steps  int
+		inputs []interface{}
+		want   string
+	}{
+		{"forward", 4, nil, "[1 2 3 0 1 2 3 0]"},
+		{"eight steps", 8, nil, "[1 2 3 4 5 6 7 0]"},
+		{"len 3", 8, []interface{}{"len", 0.03}, "[1 2 0 1 2 0 1 2]"},
+		{"len beyond steps", 4, []interface{}{"len", 0.5}, "[1 2 3 0 1 2 3 0]"},
+		{"backward", 4, []interface{}{"dir", 0.1}, "[3 2 1 0 3 2 1 0]"},
+		{"pendulum", 4, []interface{}{"dir", 0.2}, "[1 2 3 2 1 0 1 2]"},
+		{"skip", 4, []interface{}{"mode1", 0.2}, "[2 3 0 2 3 0 2 3]"},
+		{"skip pendulum", 4, []interface{}{"dir", 0.2, "mode3", 0.2}, "[1 2 1 0 1 2 1 0]"},
+		{"skip all", 2, []interface{}{"mode0", 0.2, "mode1", 0.2}, "[0 0 0 0 0 0 0 0]"},
+	} {
+		got, _ := play(c.steps, 8, c.inputs...)
+		if s := fmt.Sprint(got); s != c.want {
+			t.Errorf("%v: played %v, want %v", c.desc, s, c.want)
+		}
+	}
+
+	// Rests keep the gate low.
+	got, gate := play(4, 4, "mode2", 0.1)
+	if fmt.Sprint(got, gate) != "[1 2 3 0] [true false true true]" {
+		t.Errorf("with a rest, played %v with gates %v", got, gate)
+	}
+
+	// The random direction plays skipped steps only by accident.
+	got, _ = play(4, 100, "dir", 0.3, "mode2", 0.2)
+	seen := make(map[int]bool)
+	for _, n := range got {
+		seen[n] = true
+	}
+	if len(seen) != 3 || seen[2] {
+		t.Errorf("random direction played steps %v", seen)
+	}
+
+	// Polymeter: sequencers of 3 and 4 steps line up every 12 triggers.
+	a, _ := play(4, 12, "len", 0.03)
+	b, _ := play(4, 12)
+	if a[11] != 0 || b[11] != 0 || a[5] != 0 || b[5] == 0 {
+		t.Errorf("3 against 4 played %v and %v", a, b)
+	}
+
+	s := NewStep()
+	s.SetSteps(MaxSteps)
+	s.Input("trig", &pulse{})
+	s.Input("dir", Value(0.3))
+	buf := make([]Sample, FrameLength)
+	if n := testing.AllocsPerRun(10, func() { s.Process(buf) }); n != 0 {
+		t.Errorf("Process allocated %v times", n)
+	}
+	if n := testing.AllocsPerRun(10, func() { s.SetSteps(1); s.SetSteps(MaxSteps) }); n != 0 {
+		t.Errorf("SetSteps allocated %v times", n)
+	}
+	if n := len(s.Inputs()); n != 4+2*MaxSteps {
+		t.Errorf("%v inputs with %v steps", n, MaxSteps)
+	}
+	s.SetSteps(2)
+	s.Process(buf)
+	if n := len(s.Inputs()); n != 4+2*2 {
+		t.Errorf("%v inputs with 2 steps", n)
+	}
+}
+
 type countingProcessor int
 
 func (p *countingProcessor) Process(b []Sample) {
@@ -163,6 +1109,50 @@ func (p *countingProcessor) Process(b []Sample) {
 	Value(*p).Process(b)
 }
 
+func TestFilter(t *testing.T) {
+	// level returns the RMS level of each output of a filter with its
+	// cutoff at 440Hz, given a sine wave input of the given pitch.
+	level := func(pitch Sample) (lp, bp, hp float64) {
+		sin := NewSin()
+		sin.Input("pitch", Value(pitch))
+		f := NewFilter()
+		f.Input("in", sin)
+		f.Input("res", Value(0.5))
+		b := [][]Sample{
+			make([]Sample, FrameLength),
+			make([]Sample, FrameLength),
+			make([]Sample, FrameLength),
+		}
+		var sum [3]float64
+		for i := 0; i < 20; i++ {
+			f.ProcessMulti(b)
+			if i < 10 {
+				continue // Let the filter settle.
+			}
+			for j := range b {
+				for _, v := range b[j] {
+					sum[j] += float64(v * v)
+				}
+			}
+		}
+		n := float64(10 * FrameLength)
+		return math.Sqrt(sum[0] / n), math.Sqrt(sum[1] / n), math.Sqrt(sum[2] / n)
+	}
+	const pass, stop = 0.5, 0.05
+	if lp, _, hp := level(-0.3); lp < pass || hp > stop {
+		t.Errorf("55Hz: lp == %.3f, hp == %.3f", lp, hp)
+	}
+	if lp, _, hp := level(0.3); lp > stop || hp < pass {
+		t.Errorf("3520Hz: lp == %.3f, hp == %.3f", lp, hp)
+	}
+	_, lo, _ := level(-0.3)
+	_, mid, _ := level(0)
+	_, hi, _ := level(0.3)
+	if mid < pass || lo > mid/4 || hi > mid/4 {
+		t.Errorf("bp: 55Hz == %.3f, 440Hz == %.3f, 3520Hz == %.3f", lo, mid, hi)
+	}
+}
+
 func BenchmarkFilter(b *testing.B) {
 	f := NewFilter()
 	f.Input("in", Value(0))
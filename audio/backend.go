@@ -0,0 +1,193 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/nf/sigourney/wav"
+)
+
+// A Backend delivers the audio generated by an Engine to its destination,
+// such as a sound card or a file.
+type Backend interface {
+	// Start begins pulling audio from the Stream.
+	// It returns once the audio is flowing.
+	Start(s Stream) error
+
+	// Stop halts the flow of audio and releases any
+	// resources acquired by Start.
+	Stop() error
+}
+
+// A Stream describes the audio that an Engine provides to its Backend.
+type Stream struct {
+	SampleRate  int // Samples per second, per channel.
+	FrameLength int // Samples per frame, per channel.
+	Channels    int // Number of interleaved channels.
+
+	// Fill populates buf, which must be FrameLength*Channels samples long,
+	// with the next frame of interleaved output.
+	// The samples are in the range [-1, 1].
+	Fill func(buf []Sample)
+}
+
+// NewNullBackend returns a Backend that discards its audio,
+// pulling frames from the Engine at the rate a sound card would.
+func NewNullBackend() Backend {
+	return &loopBackend{realTime: true}
+}
+
+// NewFileBackend returns a Backend that writes its audio to the named WAV
+// file in real time. The file is created by Start and finalized by Stop.
+func NewFileBackend(name string, f wav.Format) Backend {
+	return &loopBackend{
+		realTime: true,
+		open: func(s Stream) (frameWriter, error) {
+			w, err := os.Create(name)
+			if err != nil {
+				return nil, err
+			}
+			e, err := wav.NewEncoder(w, f, s.SampleRate, s.Channels)
+			if err != nil {
+				w.Close()
+				return nil, err
+			}
+			return &wavWriter{f: w, e: e}, nil
+		},
+	}
+}
+
+// NewRawBackend returns a Backend that writes its audio to w as headerless,
+// interleaved, little-endian PCM. Frames are produced as fast as w accepts
+// them, so w should be something that consumes audio in real time, such as
+// a pipe to a player.
+func NewRawBackend(w io.Writer, f wav.Format) Backend {
+	return &loopBackend{
+		open: func(Stream) (frameWriter, error) {
+			return &rawWriter{w: w, f: f}, nil
+		},
+	}
+}
+
+// loopBackend is a Backend that drives the Stream from its own goroutine.
+type loopBackend struct {
+	realTime bool                              // Whether to pace output in real time.
+	open     func(Stream) (frameWriter, error) // May be nil, to discard output.
+
+	done chan error
+}
+
+type frameWriter interface {
+	WriteFrame([]Sample) error
+	Close() error
+}
+
+func (b *loopBackend) Start(s Stream) error {
+	var w frameWriter = nopWriter{}
+	if b.open != nil {
+		var err error
+		w, err = b.open(s)
+		if err != nil {
+			return err
+		}
+	}
+	b.done = make(chan error)
+	go b.loop(s, w, b.done)
+	return nil
+}
+
+func (b *loopBackend) loop(s Stream, w frameWriter, done chan error) {
+	buf := make([]Sample, s.FrameLength*s.Channels)
+	frame := time.Duration(s.FrameLength) * time.Second / time.Duration(s.SampleRate)
+	next := time.Now()
+	var err error
+	for err == nil {
+		select {
+		case <-done:
+			done <- w.Close()
+			return
+		default:
+		}
+		s.Fill(buf)
+		err = w.WriteFrame(buf)
+		if b.realTime {
+			next = next.Add(frame)
+			time.Sleep(next.Sub(time.Now()))
+		}
+	}
+	w.Close()
+	<-done
+	done <- err
+}
+
+func (b *loopBackend) Stop() error {
+	if b.done == nil {
+		return nil
+	}
+	b.done <- nil
+	err := <-b.done
+	b.done = nil
+	return err
+}
+
+type nopWriter struct{}
+
+func (nopWriter) WriteFrame([]Sample) error { return nil }
+func (nopWriter) Close() error              { return nil }
+
+type wavWriter struct {
+	f   *os.File
+	e   *wav.Encoder
+	buf []float64
+}
+
+func (w *wavWriter) WriteFrame(s []Sample) error {
+	w.buf = w.buf[:0]
+	for _, v := range s {
+		w.buf = append(w.buf, float64(v))
+	}
+	return w.e.Write(w.buf)
+}
+
+func (w *wavWriter) Close() error {
+	err := w.e.Close()
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+type rawWriter struct {
+	w   io.Writer
+	f   wav.Format
+	buf []byte
+}
+
+func (w *rawWriter) WriteFrame(s []Sample) error {
+	b := w.buf[:0]
+	for _, v := range s {
+		b = w.f.Append(b, float64(v))
+	}
+	w.buf = b
+	_, err := w.w.Write(b)
+	return err
+}
+
+func (w *rawWriter) Close() error { return nil }
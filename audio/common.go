@@ -24,16 +24,23 @@ import (
 	"strings"
 )
 
-const (
-	nChannels = 1
-	FrameLength  = 256 * nChannels
-)
+// FrameLength is the default number of samples
+// in each frame of a single channel.
+const FrameLength = 256
 
 const (
-	waveHz  = 44100
-	waveAmp = 1 << 15
+	waveHz  = 44100 // Default sample rate.
+	waveAmp = 1<<15 - 1
 )
 
+// A Config describes the audio stream produced by an Engine.
+type Config struct {
+	SampleRate  int // Samples per second, per channel.
+	FrameLength int // Samples per frame, per channel.
+}
+
+var defaultConfig = Config{SampleRate: waveHz, FrameLength: FrameLength}
+
 // A Sample is a single frame of audio.
 type Sample float64
 
@@ -50,6 +57,19 @@ type Processor interface {
 	Process(buffer []Sample)
 }
 
+// A MultiProcessor is a Processor with more than one named output.
+// Its Process method produces the first output.
+type MultiProcessor interface {
+	Processor
+
+	// Outputs enumerates the MultiProcessor's named outputs.
+	Outputs() []string
+
+	// ProcessMulti populates one buffer for each output,
+	// in the order given by Outputs.
+	ProcessMulti(buffers [][]Sample)
+}
+
 // A Ticker is a Processor whose Tick method is called once per audio frame.
 //
 // Each Ticker should be registered with the Engine using AddTicker on
@@ -58,6 +78,33 @@ type Ticker interface {
 	Tick()
 }
 
+// A Configurer is a Processor or Sink whose behavior depends on the
+// sample rate or frame length of the Engine that drives it.
+//
+// Each Configurer should be passed the Engine's Config on creation,
+// before its first call to Process. Until then it assumes a sample rate
+// of 44100Hz and a frame length of FrameLength.
+type Configurer interface {
+	Configure(c Config)
+}
+
+// A Seeder is a Processor whose output is random. Each has its own
+// random source, so that its output is determined by its seed.
+//
+// Seed restarts the source with the given seed. Until it is called,
+// the source is seeded with 1.
+type Seeder interface {
+	Seed(seed int64)
+}
+
+// A Stepper is a Sink with a number of steps, such as a sequencer,
+// each of which has its own numbered inputs.
+//
+// SetSteps changes the number of steps, and so the Sink's inputs.
+type Stepper interface {
+	SetSteps(n int)
+}
+
 // A Sink is a consumer of audio data with one or more named inputs.
 type Sink interface {
 	// Input attaches the given Processor to the specified named input.
@@ -69,10 +116,12 @@ type Sink interface {
 
 type sink struct {
 	m map[string]interface{}
+	c Config
 }
 
 func (s *sink) inputs(args ...interface{}) {
 	s.m = make(map[string]interface{})
+	s.c = defaultConfig
 	if len(args)%2 != 0 {
 		panic("odd number of args")
 	}
@@ -102,6 +151,24 @@ func (s *sink) inputs(args ...interface{}) {
 	}
 }
 
+// Configure implements Configurer by resizing the input buffers
+// to the new frame length.
+func (s *sink) Configure(c Config) {
+	s.c = c
+	for _, v := range s.m {
+		switch v := v.(type) {
+		case *source:
+			v.b = make([]Sample, c.FrameLength)
+		case *trigger:
+			v.b = make([]Sample, c.FrameLength)
+		case []source:
+			for i := range v {
+				v[i].b = make([]Sample, c.FrameLength)
+			}
+		}
+	}
+}
+
 func (s *sink) Input(name string, p Processor) {
 	if s.m == nil {
 		panic("no inputs registered")
@@ -0,0 +1,95 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import "time"
+
+// A crossfade holds a graph that is being faded out; see Crossfade.
+type crossfade struct {
+	in      []source // The Engine's inputs from the old graph.
+	live    []bool
+	tickers []Ticker
+	pos, n  int // Samples faded so far, and in total.
+}
+
+// Crossfade returns a function that, when passed to Do ahead of changes
+// that replace the Engine's graph, fades linearly from the old graph to
+// the new one over the duration d. Until the fade is complete, the
+// old graph continues to be processed alongside the new one.
+//
+// Starting a crossfade while another is in progress cuts off the
+// graph that was being faded out.
+//
+// Crossfade allocates what the fade needs, so that the function may be
+// called by the audio thread. The Tickers of the old graph are copied
+// when the function is called; tickers is their expected number, such
+// as the number of Dups in the old graph. The function allocates only
+// if more are registered.
+func (e *Engine) Crossfade(d time.Duration, tickers int) func() {
+	n := int(d * time.Duration(e.c.SampleRate) / time.Second)
+	if n < 1 {
+		return func() {}
+	}
+	f := &crossfade{
+		in:      make([]source, len(e.in)),
+		live:    make([]bool, len(e.in)),
+		tickers: make([]Ticker, 0, tickers),
+		n:       n,
+	}
+	for i := range f.in {
+		f.in[i].b = make([]Sample, e.c.FrameLength)
+	}
+	return func() {
+		for i := range e.in {
+			f.in[i].p = e.in[i].p
+		}
+		copy(f.live, e.live)
+		f.tickers = append(f.tickers[:0], e.tickers...)
+		e.fade = f
+	}
+}
+
+// mix processes the old graph and mixes it into out, the interleaved
+// output of the new graph. It reports whether the fade is complete.
+func (f *crossfade) mix(out []Sample) bool {
+	n := len(f.in)
+	mirror := mirrored(f.live)
+	for c := range f.in {
+		var b []Sample
+		if c > 0 && mirror {
+			b = f.in[0].b
+		} else {
+			b = f.in[c].Process()
+		}
+		for i, v := range b {
+			g := Sample(f.pos+i) / Sample(f.n)
+			if g > 1 {
+				g = 1
+			}
+			j := i*n + c
+			out[j] = g*out[j] + (1-g)*v
+		}
+	}
+	f.pos += len(f.in[0].b)
+	return f.pos >= f.n
+}
+
+func (f *crossfade) tick() {
+	for _, t := range f.tickers {
+		t.Tick()
+	}
+}
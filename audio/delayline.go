@@ -0,0 +1,155 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+const (
+	DefaultMaxDelay = 1  // Longest delay of a new DelayLine, in seconds.
+	LongestDelay    = 60 // Largest maximum delay of a DelayLine, in seconds.
+)
+
+// A Delayer is a Processor that delays its input by up to a maximum time.
+type Delayer interface {
+	// SetMaxDelay returns a function that sets the longest delay, in
+	// seconds. The memory it needs is allocated by SetMaxDelay, so that
+	// the function may be called while the Delayer is playing.
+	SetMaxDelay(seconds float64) func()
+}
+
+func NewDelayLine() *DelayLine {
+	d := &DelayLine{max: DefaultMaxDelay}
+	d.inputs("in", &d.in, "len", &d.len, "fb", &d.fb, "dry", &d.dry, "interp", &d.interp)
+	d.Configure(defaultConfig)
+	return d
+}
+
+// DelayLine delays its input by a time that may be modulated smoothly.
+//
+// The len input sets the delay time in seconds, which is read between
+// samples using the interpolation chosen by the interp input: 0 for
+// linear, 0.1 for allpass, which suits fixed delays in feedback loops,
+// or 0.2 for cubic, which suits modulated delays. The delay is at least
+// two samples, and at most the maximum set by SetMaxDelay, which is
+// DefaultMaxDelay for a new DelayLine.
+//
+// The delayed signal is scaled by the fb input and fed back into the
+// line. The dry input sets the proportion of the undelayed input in the
+// output: 0 gives only the delayed signal, and 1 only the input.
+//
+// The buffer holds the maximum delay. It is allocated by Configure and
+// SetMaxDelay, so that Process never allocates.
+type DelayLine struct {
+	sink
+	in                   Processor
+	len, fb, dry, interp source
+
+	max  float64  // Longest delay, in seconds.
+	buf  []Sample // Circular; its length is a power of two.
+	w    int      // Index of the next sample to write.
+	last Sample   // Previous output of the allpass interpolator.
+}
+
+// Interpolation modes, selected by the interp input in steps of 0.1.
+const (
+	interpLinear = iota
+	interpAllpass
+	interpCubic
+)
+
+// Configure implements Configurer.
+func (d *DelayLine) Configure(c Config) {
+	d.sink.Configure(c)
+	d.buf, d.w, d.last = make([]Sample, pow2(d.maxSamples()+4)), 0, 0
+}
+
+// SetMaxDelay implements Delayer. The function it returns resizes
+// the buffer, keeping the most recent samples it holds.
+func (d *DelayLine) SetMaxDelay(seconds float64) func() {
+	buf := make([]Sample, pow2(int(seconds*float64(d.c.SampleRate))+4))
+	return func() {
+		size, mask := len(buf), len(d.buf)-1
+		for k := 1; k <= len(d.buf) && k <= size; k++ {
+			buf[size-k] = d.buf[(d.w-k)&mask]
+		}
+		d.max, d.buf, d.w = seconds, buf, 0
+	}
+}
+
+func (d *DelayLine) maxSamples() int {
+	return int(d.max * float64(d.c.SampleRate))
+}
+
+func (d *DelayLine) Process(s []Sample) {
+	d.in.Process(s)
+	l, fb, dry, interp := d.len.Process(), d.fb.Process(), d.dry.Process(), d.interp.Process()
+	rate := float64(d.c.SampleRate)
+	buf, mask, w, last := d.buf, len(d.buf)-1, d.w, d.last
+	limit := float64(len(buf) - 3)
+	if m := float64(d.maxSamples()); m < limit {
+		limit = m
+	}
+	for i, x := range s {
+		t := float64(l[i]) * rate
+		if t < 2 {
+			t = 2
+		} else if t > limit {
+			t = limit
+		}
+		n := int(t)
+		f := Sample(t - float64(n))
+		// The sample k samples ago is buf[(w-k)&mask].
+		var y Sample
+		switch mode := int(interp[i]*10 + 0.5); {
+		case mode <= interpLinear:
+			a, b := buf[(w-n)&mask], buf[(w-n-1)&mask]
+			y = a + f*(b-a)
+		case mode == interpAllpass:
+			if f < 0.1 {
+				// Keep the fraction away from 0, where the
+				// allpass filter's pole approaches z = -1.
+				n, f = n-1, f+1
+			}
+			eta := (1 - f) / (1 + f)
+			y = eta*(buf[(w-n)&mask]-last) + buf[(w-n-1)&mask]
+		default:
+			y = hermite(buf[(w-n+1)&mask], buf[(w-n)&mask],
+				buf[(w-n-1)&mask], buf[(w-n-2)&mask], f)
+		}
+		last = y
+		buf[w] = x + fb[i]*y
+		w = (w + 1) & mask
+		s[i] = y + dry[i]*(x-y)
+	}
+	d.w, d.last = w, last
+}
+
+// hermite interpolates between x0 and x1, at the fraction f of the way
+// from one to the other, using the neighbouring samples xm1 and x2.
+func hermite(xm1, x0, x1, x2, f Sample) Sample {
+	c1 := (x1 - xm1) / 2
+	c2 := xm1 - 2.5*x0 + 2*x1 - x2/2
+	c3 := (x2-xm1)/2 + 1.5*(x0-x1)
+	return ((c3*f+c2)*f+c1)*f + x0
+}
+
+// pow2 returns the smallest power of two that is at least n.
+func pow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
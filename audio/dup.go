@@ -17,10 +17,15 @@ limitations under the License.
 package audio
 
 // Dup splits a Processor into multiple audio streams.
+//
+// The source is processed once per frame, when the first Output is
+// processed after a call to Tick. The remaining Outputs copy its result.
+// If the source is a MultiProcessor, each Output may carry any one of
+// its outputs.
 type Dup struct {
 	src  Processor
-	outs []*Output
-	buf  []Sample
+	bufs [][]Sample // One per output of src.
+	next [][]Sample // Buffers being processed; see process.
 	done bool
 }
 
@@ -38,41 +43,59 @@ func (d *Dup) SetSource(p Processor) {
 	d.src = p
 }
 
-// Output creates and returns a new Output Processor.
-// Each Output should be Closed when it is no longer in use.
+// Output creates and returns a new Output Processor
+// that carries the first output of the source.
+// It does not modify the Dup, so it is safe to call
+// while another goroutine is processing the Dup's Outputs.
 func (d *Dup) Output() *Output {
-	o := &Output{d: d}
-	d.outs = append(d.outs, o)
-	if len(d.outs) > 1 && d.buf == nil {
-		d.buf = make([]Sample, FrameLength)
-	}
-	return o
+	return &Output{d: d}
 }
 
-// An Output is a Processor endpoint provided by Dup.
-type Output struct {
-	d *Dup
+// OutputN is like Output, but carries the source's output with
+// index n in the list returned by its Outputs method.
+func (d *Dup) OutputN(n int) *Output {
+	return &Output{d: d, n: n}
 }
 
-func (o *Output) Process(p []Sample) {
-	if !o.d.done {
-		o.d.done = true
-		o.d.src.Process(p)
-		if len(o.d.outs) > 1 {
-			copy(o.d.buf, p)
+// process processes the source into the Dup's buffers of n samples,
+// if it has not been processed since the last Tick.
+func (d *Dup) process(n int) {
+	if d.done {
+		return
+	}
+	d.done = true
+	outs := 1
+	m, multi := d.src.(MultiProcessor)
+	if multi {
+		outs = len(m.Outputs())
+	}
+	for len(d.bufs) < outs {
+		d.bufs = append(d.bufs, nil)
+		d.next = append(d.next, nil)
+	}
+	for i := range d.bufs {
+		if len(d.bufs[i]) != n {
+			d.bufs[i] = make([]Sample, n)
+			d.next[i] = make([]Sample, n)
 		}
+	}
+	// Process into a separate set of buffers, so that Outputs processed
+	// meanwhile (by a feedback loop) see the previous frame's output.
+	if multi {
+		m.ProcessMulti(d.next[:outs])
 	} else {
-		copy(p, o.d.buf)
+		d.src.Process(d.next[0])
 	}
+	d.bufs, d.next = d.next, d.bufs
 }
 
-func (o *Output) Close() {
-	outs := o.d.outs
-	for i, o2 := range outs {
-		if o == o2 {
-			copy(outs[i:], outs[i+1:])
-			o.d.outs = outs[:len(outs)-1]
-			break
-		}
-	}
+// An Output is a Processor endpoint provided by Dup.
+type Output struct {
+	d *Dup
+	n int // Index of the source output.
+}
+
+func (o *Output) Process(p []Sample) {
+	o.d.process(len(p))
+	copy(p, o.d.bufs[o.n])
 }
@@ -0,0 +1,214 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import "math"
+
+// dynamics implements the gain computer shared by Compressor and the
+// Engine's master limiter. The gain is linked across channels.
+//
+// Its control inputs are:
+//
+//	thresh: 0.01/dB, 0 == 0dBFS
+//	ratio:  compression ratio; values below 1 mean limiting (∞:1)
+//	att:    attack time in seconds; 0 == instant
+//	rel:    release time in seconds; 0 == defaultRelease
+//	ceil:   0.01/dB, 0 == 0dBFS; a hard limit on the output level
+type dynamics struct {
+	rate     int
+	channels int
+	look     int // Lookahead, in sample frames.
+
+	delay []Sample // Lookahead delay line, look*channels samples.
+	dp    int      // Pointer into delay.
+
+	// A monotonic queue holding the minimum target gain of the
+	// last look+1 sample frames, stored as a circular buffer.
+	qt   []int
+	qg   []Sample
+	qh   int // Index of the queue head.
+	qn   int // Length of the queue.
+	t    int // Sample frames processed.
+	gain Sample
+
+	thresh, ceil, att, rel memo
+}
+
+const defaultRelease = 0.1 // seconds
+
+func newDynamics(rate, channels, look int) *dynamics {
+	return &dynamics{
+		rate:     rate,
+		channels: channels,
+		look:     look,
+		delay:    make([]Sample, look*channels),
+		qt:       make([]int, look+1),
+		qg:       make([]Sample, look+1),
+		gain:     1,
+	}
+}
+
+// process applies gain reduction to the interleaved sample frames in buf.
+// The control slices hold one value per sample frame.
+// If ceil is nil no ceiling is applied.
+func (d *dynamics) process(buf, thresh, ratio, att, rel, ceil []Sample) {
+	n, size := d.channels, len(d.qt)
+	for i := 0; i < len(buf)/n; i++ {
+		x := buf[i*n : i*n+n]
+
+		// Compute the gain required by this sample frame.
+		level := Sample(0)
+		for _, v := range x {
+			if v < 0 {
+				v = -v
+			}
+			if v > level {
+				level = v
+			}
+		}
+		g := Sample(1)
+		th := d.thresh.get(thresh[i], dbToGain)
+		if level > th {
+			if r := ratio[i]; r < 1 {
+				g = th / level
+			} else {
+				g = th * Sample(math.Pow(float64(level/th), float64(1/r))) / level
+			}
+		}
+		if ceil != nil {
+			if c := d.ceil.get(ceil[i], dbToGain); level*g > c {
+				g = c / level
+			}
+		}
+
+		// Find the minimum gain required by the lookahead window.
+		if d.qn > 0 && d.qt[d.qh] <= d.t-size {
+			d.qh = (d.qh + 1) % size
+			d.qn--
+		}
+		for d.qn > 0 && d.qg[(d.qh+d.qn-1)%size] >= g {
+			d.qn--
+		}
+		d.qt[(d.qh+d.qn)%size], d.qg[(d.qh+d.qn)%size] = d.t, g
+		d.qn++
+		d.t++
+		g = d.qg[d.qh]
+
+		// Smooth the gain.
+		var coef Sample
+		if g < d.gain {
+			coef = d.att.get(att[i]*Sample(d.rate), timeToCoef)
+		} else {
+			r := rel[i]
+			if r <= 0 {
+				r = defaultRelease
+			}
+			coef = d.rel.get(r*Sample(d.rate), timeToCoef)
+		}
+		d.gain = g + (d.gain-g)*coef
+
+		// Delay the signal by the lookahead time and apply the gain.
+		if d.look > 0 {
+			y := d.delay[d.dp : d.dp+n]
+			for c := range x {
+				x[c], y[c] = y[c], x[c]
+			}
+			d.dp += n
+			if d.dp >= len(d.delay) {
+				d.dp = 0
+			}
+		}
+		for c := range x {
+			x[c] *= d.gain
+		}
+		if ceil != nil {
+			// The smoothed gain may lag behind a sharp transient;
+			// clip anything that remains above the ceiling.
+			c := d.ceil.out
+			for j, v := range x {
+				if v > c {
+					x[j] = c
+				} else if v < -c {
+					x[j] = -c
+				}
+			}
+		}
+	}
+}
+
+// dbToGain converts a level in 0.01/dB to a linear gain.
+func dbToGain(v Sample) Sample {
+	return Sample(math.Pow(10, float64(v)*100/20))
+}
+
+// timeToCoef converts a time constant in samples to the coefficient
+// of a one-pole smoothing filter. Times of zero or less are instant.
+func timeToCoef(n Sample) Sample {
+	if n <= 0 {
+		return 0
+	}
+	return Sample(math.Exp(-1 / float64(n)))
+}
+
+// memo caches the result of an expensive conversion of a control input,
+// which usually changes far less often than once per sample.
+type memo struct {
+	in, out Sample
+	ok      bool
+}
+
+func (m *memo) get(v Sample, f func(Sample) Sample) Sample {
+	if !m.ok || v != m.in {
+		m.in, m.out, m.ok = v, f(v), true
+	}
+	return m.out
+}
+
+func NewCompressor() *Compressor {
+	c := &Compressor{d: newDynamics(waveHz, 1, 0)}
+	c.inputs("in", &c.in, "thresh", &c.thresh, "ratio", &c.ratio,
+		"att", &c.att, "rel", &c.rel, "gain", &c.gain)
+	return c
+}
+
+// Compressor reduces the dynamic range of its input.
+// See the dynamics type for a description of its control inputs.
+// The gain input applies make-up gain in 0.01/dB, 0 == unity.
+type Compressor struct {
+	sink
+	in                            Processor
+	thresh, ratio, att, rel, gain source
+
+	d *dynamics
+	g memo
+}
+
+// Configure implements Configurer.
+func (c *Compressor) Configure(cfg Config) {
+	c.sink.Configure(cfg)
+	c.d = newDynamics(cfg.SampleRate, 1, 0)
+}
+
+func (c *Compressor) Process(s []Sample) {
+	c.in.Process(s)
+	th, ra, at, re, ga := c.thresh.Process(), c.ratio.Process(),
+		c.att.Process(), c.rel.Process(), c.gain.Process()
+	c.d.process(s, th, ra, at, re, nil)
+	for i := range s {
+		s[i] *= c.g.get(ga[i], dbToGain)
+	}
+}
@@ -16,31 +16,215 @@ limitations under the License.
 
 package audio
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
-func NewEngine() *Engine {
-	e := &Engine{done: make(chan error), max: 1}
-	e.inputs("in", &e.in)
+// An Option configures an Engine.
+type Option func(*Engine)
+
+// Channels sets the number of output channels produced by the Engine.
+// The default is 1.
+func Channels(n int) Option {
+	return func(e *Engine) {
+		if n < 1 {
+			panic("audio: bad channel count")
+		}
+		e.in = make([]source, n)
+	}
+}
+
+// SampleRate sets the number of samples per second produced by the Engine.
+// The default is 44100.
+func SampleRate(hz int) Option {
+	return func(e *Engine) {
+		if hz < 1 {
+			panic("audio: bad sample rate")
+		}
+		e.c.SampleRate = hz
+	}
+}
+
+// BlockSize sets the number of samples per channel in each frame
+// produced by the Engine. The default is FrameLength.
+// Smaller blocks reduce latency at the cost of more overhead.
+func BlockSize(n int) Option {
+	return func(e *Engine) {
+		if n < 1 {
+			panic("audio: bad block size")
+		}
+		e.c.FrameLength = n
+	}
+}
+
+// Lookahead sets how far ahead the Engine's master limiter looks for peaks,
+// which is also the latency it adds. The default is 5ms.
+func Lookahead(d time.Duration) Option {
+	return func(e *Engine) {
+		if d < 0 {
+			panic("audio: bad lookahead")
+		}
+		e.look = d
+	}
+}
+
+func NewEngine(opts ...Option) *Engine {
+	e := &Engine{backend: NewPortAudioBackend(), look: 5 * time.Millisecond, workers: 1}
+	e.in = make([]source, 1)
+	e.c = defaultConfig
+	for _, o := range opts {
+		o(e)
+	}
+	c := e.c
+	in := interface{}(e.in)
+	if len(e.in) == 1 {
+		in = &e.in[0]
+	}
+	e.inputs("in", in, "thresh", &e.thresh, "ratio", &e.ratio,
+		"att", &e.att, "rel", &e.rel, "ceil", &e.ceil)
+	e.sink.Configure(c)
+	e.live = make([]bool, len(e.in))
+	e.out = make([]Sample, c.FrameLength*len(e.in))
+	look := int(e.look * time.Duration(c.SampleRate) / time.Second)
+	e.dyn = newDynamics(c.SampleRate, len(e.in), look)
 	return e
 }
 
 // Engine implements the root of an Processor graph.
+//
+// An Engine with one channel has a single input named "in".
+// An Engine with n channels has inputs "in0" through "in<n-1>".
+// If only "in0" is connected its signal is sent to every channel,
+// so that mono patches play on all speakers.
+//
+// The output passes through a master limiter, controlled by the inputs
+// "thresh", "ratio", "att", "rel", and "ceil". These behave as they do for
+// Compressor, with the addition of "ceil", a hard limit on the output level
+// in 0.01/dB (0 == 0dBFS). With nothing connected, the limiter holds peaks
+// to 0dBFS and releases over 100ms.
+//
+// Once the Engine is running, the Processor graph it drives belongs to the
+// audio thread. Changes to the graph must be made by passing functions to Do.
 type Engine struct {
-	sync.Mutex // Must be held while mutating the Processor graph.
-
 	sink
-	in source
+	in   []source // One per channel.
+	live []bool   // Whether each channel's input is connected.
+	out  []Sample // Interleaved output buffer.
+
+	thresh, ratio, att, rel, ceil source // Master limiter controls.
 
-	done    chan error
+	backend Backend
 	tickers []Ticker
+	cmds    queue // Graph mutations waiting to be run by Process.
+
+	workers int
+	plan    *plan          // Schedule for concurrent processing; see Plan.
+	work    chan []*Dup    // Sends Dups to the workers.
+	wg      sync.WaitGroup // Counts Dups in progress.
+
+	look time.Duration
+	dyn  *dynamics // Master limiter.
+
+	running bool       // Whether the Backend is running.
+	rec     *Recorder  // Receives the output, if recording.
+	fade    *crossfade // The graph being faded out, if any.
+}
+
+func (e *Engine) Input(name string, p Processor) {
+	e.sink.Input(name, p)
+	for i := range e.in {
+		v, ok := e.in[i].p.(Value)
+		e.live[i] = !ok || v != 0
+	}
+}
+
+// SetBackend sets the Backend that receives the Engine's output.
+// It must not be called while the Engine is running.
+// The default Backend is the one returned by NewPortAudioBackend.
+func (e *Engine) SetBackend(b Backend) {
+	e.backend = b
+}
 
-	max Sample // for limiter
+// Start starts delivering audio to the Engine's Backend.
+func (e *Engine) Start() error {
+	err := e.backend.Start(Stream{
+		SampleRate:  e.c.SampleRate,
+		FrameLength: e.c.FrameLength,
+		Channels:    len(e.in),
+		Fill:        e.processAudio,
+	})
+	e.running = err == nil
+	return err
 }
 
+// Stop stops the Engine's Backend.
+func (e *Engine) Stop() error {
+	err := e.backend.Stop()
+	e.running = false
+	e.stopWorkers()
+	return err
+}
+
+// Channels returns the number of output channels produced by the Engine.
+func (e *Engine) Channels() int {
+	return len(e.in)
+}
+
+// Config returns the Engine's sample rate and frame length.
+// It should be passed to the Configure method of each Configurer
+// that the Engine drives.
+func (e *Engine) Config() Config {
+	return e.c
+}
+
+// SampleRate returns the number of samples per second produced by the Engine.
+func (e *Engine) SampleRate() int {
+	return e.c.SampleRate
+}
+
+// Workers returns the number of goroutines that process the Engine's graph.
+func (e *Engine) Workers() int {
+	return e.workers
+}
+
+// FrameLength returns the number of samples per channel
+// in each frame produced by the Engine.
+func (e *Engine) FrameLength() int {
+	return e.c.FrameLength
+}
+
+// Do arranges for the given functions to be called, in order, by the
+// goroutine that drives the Engine, before it processes the next frame.
+// The functions passed to a single call of Do are run together, so the
+// Processor graph is never seen in an intermediate state. Do never blocks,
+// and the goroutine that drives the Engine never waits for a caller of Do.
+//
+// The functions should be short and must not block;
+// any expensive work should be done before calling Do.
+func (e *Engine) Do(fs ...func()) {
+	e.cmds.push(fs)
+}
+
+// audioDo calls f on the audio thread if the Engine is running,
+// or directly, after any functions still waiting to be run, if it is not.
+func (e *Engine) audioDo(f func()) {
+	if e.running {
+		e.Do(f)
+		return
+	}
+	e.cmds.run()
+	f()
+}
+
+// AddTicker registers t with the Engine.
+// Once the Engine is running it should only be called from within Do.
 func (e *Engine) AddTicker(t Ticker) {
 	e.tickers = append(e.tickers, t)
 }
 
+// RemoveTicker unregisters t with the Engine.
+// Once the Engine is running it should only be called from within Do.
 func (e *Engine) RemoveTicker(t Ticker) {
 	ts := e.tickers
 	for i, t2 := range ts {
@@ -52,21 +236,74 @@ func (e *Engine) RemoveTicker(t Ticker) {
 	}
 }
 
+// Process computes the next frame of output and returns it as
+// FrameLength() samples for each channel, interleaved.
 func (e *Engine) Process() []Sample {
-	e.Lock()
-	buf := e.in.Process()
+	e.cmds.run()
+	e.runPlan()
+	n := len(e.in)
+	mirror := mirrored(e.live)
+	for c := range e.in {
+		var b []Sample
+		if c > 0 && mirror {
+			b = e.in[0].b
+		} else {
+			b = e.in[c].Process()
+		}
+		for i, v := range b {
+			e.out[i*n+c] = v
+		}
+	}
+	e.thresh.Process()
+	e.ratio.Process()
+	e.att.Process()
+	e.rel.Process()
+	e.ceil.Process()
+	done := e.fade != nil && e.fade.mix(e.out)
 	for _, t := range e.tickers {
 		t.Tick()
 	}
-	e.Unlock()
+	if e.fade != nil {
+		e.fade.tick()
+		if done {
+			e.fade = nil
+		}
+	}
 
-	return buf
+	return e.out
 }
 
+// mirrored reports whether the signal of the first channel should be
+// sent to every channel, because only the first input is connected.
+func mirrored(live []bool) bool {
+	m := live[0]
+	for _, l := range live[1:] {
+		m = m && !l
+	}
+	return m
+}
+
+// Render returns the next frames of output,
+// as they would be delivered to the Engine's Backend.
+// If the Engine is not running, any workers started to render
+// the frames are stopped before Render returns.
 func (e *Engine) Render(frames int) []Sample {
-	out := make([]Sample, 0, frames*FrameLength)
+	out := make([]Sample, frames*len(e.out))
 	for i := 0; i < frames; i++ {
-		out = append(out, e.Process()...)
+		e.processAudio(out[i*len(e.out) : (i+1)*len(e.out)])
+	}
+	if !e.running {
+		e.stopWorkers()
 	}
 	return out
 }
+
+// processAudio populates buf with the next frame of output,
+// passed through the master limiter.
+func (e *Engine) processAudio(buf []Sample) {
+	copy(buf, e.Process())
+	e.dyn.process(buf, e.thresh.b, e.ratio.b, e.att.b, e.rel.b, e.ceil.b)
+	if e.rec != nil {
+		e.rec.record(buf)
+	}
+}
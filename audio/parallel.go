@@ -0,0 +1,217 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+// A Graph describes which Dups read from which other Dups, so that an
+// Engine with more than one worker can process independent Dups
+// concurrently.
+type Graph struct {
+	deps  map[*Dup][]*Dup
+	roots []*Dup
+}
+
+func NewGraph() *Graph {
+	return &Graph{deps: make(map[*Dup][]*Dup)}
+}
+
+// Add records that the source of d reads from the Outputs of deps.
+func (g *Graph) Add(d *Dup, deps ...*Dup) {
+	g.deps[d] = append(g.deps[d], deps...)
+}
+
+// Root records that the Engine reads from an Output of d.
+func (g *Graph) Root(d *Dup) {
+	g.roots = append(g.roots, d)
+}
+
+// A plan is a schedule for processing Dups ahead of the Engine's serial
+// pass. Each level holds Dups that depend only on Dups in earlier levels,
+// so the Dups within a level may be processed concurrently.
+//
+// Only Dups whose output does not depend on the order of evaluation are
+// included: a Dup is left for the serial pass if it is part of a feedback
+// loop (where the order decides which Output sees last frame's data),
+// or if it reads from any Dup left for the serial pass. Dups the Engine can't reach are left
+// out too, so that they aren't advanced when they otherwise wouldn't be.
+type plan struct {
+	levels [][]*Dup
+}
+
+// Plan compiles g into a schedule for the Engine's workers.
+// The returned function installs the schedule; it should be passed to Do
+// together with the graph mutations that g reflects.
+// If the Engine has only one worker, Plan does nothing.
+func (e *Engine) Plan(g *Graph) func() {
+	if e.workers < 2 {
+		return func() {}
+	}
+	p := compilePlan(g)
+	return func() { e.plan = p }
+}
+
+func compilePlan(g *Graph) *plan {
+	// Find the Dups that are part of a feedback loop,
+	// using Tarjan's strongly connected components algorithm.
+	var (
+		index   = make(map[*Dup]int)
+		low     = make(map[*Dup]int)
+		onStack = make(map[*Dup]bool)
+		stack   []*Dup
+		cyclic  = make(map[*Dup]bool)
+		visit   func(d *Dup)
+	)
+	visit = func(d *Dup) {
+		index[d] = len(index)
+		low[d] = index[d]
+		stack = append(stack, d)
+		onStack[d] = true
+		for _, d2 := range g.deps[d] {
+			if _, ok := index[d2]; !ok {
+				visit(d2)
+				if low[d2] < low[d] {
+					low[d] = low[d2]
+				}
+			} else if onStack[d2] && index[d2] < low[d] {
+				low[d] = index[d2]
+			}
+			if d2 == d {
+				cyclic[d] = true
+			}
+		}
+		if low[d] == index[d] {
+			n := len(stack) - 1
+			for stack[n] != d {
+				n--
+			}
+			if len(stack)-n > 1 {
+				for _, d2 := range stack[n:] {
+					cyclic[d2] = true
+				}
+			}
+			for _, d2 := range stack[n:] {
+				onStack[d2] = false
+			}
+			stack = stack[:n]
+		}
+	}
+	for _, d := range g.roots {
+		if _, ok := index[d]; !ok {
+			visit(d)
+		}
+	}
+
+	// Assign each eligible Dup to the level after its latest dependency.
+	// Ineligible Dups are assigned level -1.
+	level := make(map[*Dup]int)
+	var assign func(d *Dup) int
+	assign = func(d *Dup) int {
+		if l, ok := level[d]; ok {
+			return l
+		}
+		l := -1
+		if !cyclic[d] {
+			l = 0
+			for _, d2 := range g.deps[d] {
+				l2 := assign(d2)
+				if l2 < 0 {
+					l = -1
+					break
+				}
+				if l2 >= l {
+					l = l2 + 1
+				}
+			}
+		}
+		level[d] = l
+		return l
+	}
+	p := &plan{}
+	for d := range index {
+		if l := assign(d); l >= 0 {
+			for len(p.levels) <= l {
+				p.levels = append(p.levels, nil)
+			}
+			p.levels[l] = append(p.levels[l], d)
+		}
+	}
+	return p
+}
+
+// Workers sets the number of goroutines that process the Engine's
+// Processor graph. The default is 1, which processes the graph serially.
+//
+// With more than one worker, the Engine processes independent parts of
+// the graph concurrently according to the Graph passed to Plan.
+// The output is identical to that of serial processing.
+func Workers(n int) Option {
+	return func(e *Engine) {
+		if n < 1 {
+			panic("audio: bad worker count")
+		}
+		e.workers = n
+	}
+}
+
+// runPlan processes the Dups in the Engine's plan, level by level,
+// splitting each level between the calling goroutine and the workers.
+func (e *Engine) runPlan() {
+	if e.plan == nil {
+		return
+	}
+	if e.work == nil {
+		e.work = make(chan []*Dup)
+		for i := 1; i < e.workers; i++ {
+			go e.worker(e.work)
+		}
+	}
+	n := e.c.FrameLength
+	for _, l := range e.plan.levels {
+		// Give each goroutine an equal share of the level,
+		// keeping the first share for ourselves.
+		parts := e.workers
+		if len(l) < parts {
+			parts = len(l)
+		}
+		e.wg.Add(parts - 1)
+		for i := 1; i < parts; i++ {
+			e.work <- l[i*len(l)/parts : (i+1)*len(l)/parts]
+		}
+		for _, d := range l[:len(l)/parts] {
+			d.process(n)
+		}
+		e.wg.Wait()
+	}
+}
+
+func (e *Engine) worker(work chan []*Dup) {
+	n := e.c.FrameLength
+	for ds := range work {
+		for _, d := range ds {
+			d.process(n)
+		}
+		e.wg.Done()
+	}
+}
+
+// stopWorkers stops the worker goroutines, if any.
+// They are restarted by the next call to runPlan.
+func (e *Engine) stopWorkers() {
+	if e.work != nil {
+		close(e.work)
+		e.work = nil
+	}
+}
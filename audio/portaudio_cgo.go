@@ -20,11 +20,26 @@ package audio
 
 import "github.com/gordonklaus/portaudio"
 
-func (e *Engine) Start() error {
-	stream, err := portaudio.OpenDefaultStream(0, 1, waveHz, FrameLength, e.processAudio)
+// NewPortAudioBackend returns a Backend that plays audio through the default
+// PortAudio output device.
+func NewPortAudioBackend() Backend {
+	return &portAudioBackend{}
+}
+
+type portAudioBackend struct {
+	fill func([]Sample)
+	buf  []Sample
+	done chan error
+}
+
+func (b *portAudioBackend) Start(s Stream) error {
+	b.fill = s.Fill
+	b.buf = make([]Sample, s.FrameLength*s.Channels)
+	stream, err := portaudio.OpenDefaultStream(0, s.Channels, float64(s.SampleRate), s.FrameLength, b.process)
 	if err != nil {
 		return err
 	}
+	done := make(chan error)
 	errc := make(chan error)
 	go func() {
 		err = stream.Start()
@@ -32,36 +47,33 @@ func (e *Engine) Start() error {
 		if err != nil {
 			return
 		}
-		<-e.done
+		<-done
 		err = stream.Stop()
 		if err == nil {
 			err = stream.Close()
 		}
-		e.done <- err
+		done <- err
 	}()
-	return <-errc
-}
-
-func (e *Engine) Stop() error {
-	e.done <- nil
-	return <-e.done
+	if err := <-errc; err != nil {
+		return err
+	}
+	b.done = done
+	return nil
 }
 
-func (e *Engine) processAudio(_, out []int16) {
-	buf := e.Process()
-
-	// Limiter
-	for i, v := range buf {
-		if v < 0 {
-			v *= -1
-		}
-		if v > e.max {
-			e.max = v
-		}
-		buf[i] *= 1 / e.max
+func (b *portAudioBackend) Stop() error {
+	if b.done == nil {
+		return nil
 	}
+	b.done <- nil
+	err := <-b.done
+	b.done = nil
+	return err
+}
 
-	for i, s := range buf {
+func (b *portAudioBackend) process(_, out []int16) {
+	b.fill(b.buf)
+	for i, s := range b.buf {
 		out[i] = int16(s * waveAmp)
 	}
 }
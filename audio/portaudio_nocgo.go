@@ -20,10 +20,21 @@ package audio
 
 import "fmt"
 
-func (e *Engine) Start() error {
-	return fmt.Errorf("audio disabled: package audio was compiled without cgo")
+// NewPortAudioBackend returns a Backend that plays audio through the default
+// PortAudio output device.
+//
+// This build was compiled without cgo, so the returned Backend always fails
+// to Start.
+func NewPortAudioBackend() Backend {
+	return portAudioBackend{}
 }
 
-func (e *Engine) Stop() error {
+type portAudioBackend struct{}
+
+func (portAudioBackend) Start(Stream) error {
+	return fmt.Errorf("portaudio disabled: package audio was compiled without cgo")
+}
+
+func (portAudioBackend) Stop() error {
 	return nil
 }
@@ -54,7 +54,7 @@ func (o *Sin) Process(s []Sample) {
 			hz = sampleToHz(s[i])
 		}
 		s[i] = Sample(fast.Sin(p * 2 * math.Pi))
-		p += hz / waveHz
+		p += hz / float64(o.c.SampleRate)
 		if p > 100 {
 			p -= 100
 		}
@@ -143,14 +143,14 @@ type Env struct {
 func (e *Env) Process(s []Sample) {
 	e.gate.Process(s)
 	att, dec, t := e.att.Process(), e.dec.Process(), e.trig.Process()
-	v := e.v
+	v, rate := e.v, Sample(e.c.SampleRate)
 	for i := range s {
 		if e.trig.isTrigger(t[i]) {
 			e.up = true
 		}
 		if !e.up && v > s[i] {
 			if d := dec[i]; d > 0 {
-				v -= 1 / (d * waveHz * 10)
+				v -= 1 / (d * rate * 10)
 				if v < s[i] {
 					v = s[i]
 				}
@@ -160,7 +160,7 @@ func (e *Env) Process(s []Sample) {
 		}
 		if e.up || v < s[i] {
 			if a := att[i]; a > 0 {
-				v += 1 / (a * waveHz * 10)
+				v += 1 / (a * rate * 10)
 				if e.up {
 					if v > 1 {
 						v = 1
@@ -212,7 +212,7 @@ func (v Value) Process(s []Sample) {
 }
 
 func NewRand() *Rand {
-	r := &Rand{}
+	r := &Rand{rnd: rand.New(rand.NewSource(1))}
 	r.inputs("min", &r.min, "max", &r.max, "trig", &r.trig)
 	return r
 }
@@ -223,16 +223,22 @@ type Rand struct {
 	max  source
 	trig trigger
 
+	rnd  *rand.Rand
 	last Sample
 }
 
+// Seed implements Seeder.
+func (r *Rand) Seed(seed int64) {
+	r.rnd.Seed(seed)
+}
+
 func (r *Rand) Process(s []Sample) {
 	r.min.Process(s)
 	max, t := r.max.Process(), r.trig.Process()
 	v := r.last
 	for i := range s {
 		if r.trig.isTrigger(t[i]) {
-			v = s[i] + Sample(rand.Float64())*(max[i]-s[i])
+			v = s[i] + Sample(r.rnd.Float64())*(max[i]-s[i])
 		}
 		s[i] = v
 	}
@@ -245,6 +251,13 @@ func NewDelay() *Delay {
 	return d
 }
 
+// Configure implements Configurer.
+// The delay buffer holds one second of audio.
+func (d *Delay) Configure(c Config) {
+	d.sink.Configure(c)
+	d.buf, d.p = make([]Sample, c.SampleRate), 0
+}
+
 type Delay struct {
 	sink
 	in  Processor
@@ -257,14 +270,14 @@ type Delay struct {
 func (d *Delay) Process(s []Sample) {
 	d.in.Process(s)
 	l := d.len.Process()
-	p := d.p
+	p, rate := d.p, d.c.SampleRate
 	for i := range s {
-		max := int(l[i] * waveHz)
-		if max < FrameLength {
+		max := int(l[i] * Sample(rate))
+		if max < d.c.FrameLength {
 			continue
 		}
-		if max > waveHz {
-			max = waveHz
+		if max > rate {
+			max = rate
 		}
 		if p >= max {
 			p = 0
@@ -324,106 +337,112 @@ func (s *Skip) Process(b []Sample) {
 	}
 }
 
-func NewStep() *Step {
-	s := &Step{}
-	s.inputs("trig", &s.trig, "rst", &s.rst, "v", s.in[:])
-	return s
-}
-
-type Step struct {
-	sink
-	trig, rst trigger
-	in        [nStep]source
-
-	n int
-}
-
-const nStep = 4
-
-func (s *Step) Process(b []Sample) {
-	t, r := s.trig.Process(), s.rst.Process()
-	in := make([][]Sample, 8)
-	for i := range s.in {
-		in[i] = s.in[i].Process()
-	}
-	for i := range b {
-		if s.trig.isTrigger(t[i]) {
-			s.n = (s.n + 1) % nStep
-		}
-		if s.rst.isTrigger(r[i]) {
-			s.n = 0
-		}
-		b[i] = in[s.n][i]
-	}
-}
-
 func NewNoise() *Noise {
-	return &Noise{}
+	return &Noise{rnd: rand.New(rand.NewSource(1))}
 }
 
 type Noise struct {
+	rnd *rand.Rand
+}
+
+// Seed implements Seeder.
+func (p *Noise) Seed(seed int64) {
+	p.rnd.Seed(seed)
 }
 
 func (p *Noise) Process(s []Sample) {
 	for i := range s {
-		s[i] = Sample(rand.Float64()*2 - 1)
+		s[i] = Sample(p.rnd.Float64()*2 - 1)
 	}
 }
 
 func NewFilter() *Filter {
-	f := &Filter{buf: make([]Sample, maxFilterBufferLength)}
-	f.inputs("in", &f.in, "freq", &f.freq)
+	f := &Filter{}
+	f.inputs("in", &f.in, "freq", &f.freq, "res", &f.res)
+	f.Configure(defaultConfig)
 	return f
 }
 
-const maxFilterBufferLength = 1024
-
+// Filter is a resonant state-variable filter.
+//
+// The freq input sets the cutoff frequency on the same scale as pitch
+// (0 == 440Hz, 0.1/oct) and res sets the resonance, from 0 (none) to 1
+// (on the verge of self-oscillation).
+// The filter has three outputs: "lp" (low-pass), "bp" (band-pass),
+// and "hp" (high-pass).
 type Filter struct {
 	sink
-	in   Processor
-	freq source
+	in        Processor
+	freq, res source
+
+	ic1, ic2 Sample // Integrator states.
+
+	// Coefficients, and the inputs they were computed from.
+	lastFreq, lastRes Sample
+	k, a1, a2, a3     Sample
+	ok                bool
+}
 
-	buf  []Sample // Circular buffer.
-	bufp int      // Pointer into circular buffer.
-	avg  Sample   // Rolling average.
+var filterOutputs = []string{"lp", "bp", "hp"}
+
+// Configure implements Configurer.
+func (f *Filter) Configure(c Config) {
+	f.sink.Configure(c)
+	f.ic1, f.ic2, f.ok = 0, 0, false
 }
 
-// TODO(adg): write a better circular buffer implementation that can
-// grow and shrink as necessary, while maintaining its circularity.
+func (f *Filter) Outputs() []string {
+	return filterOutputs
+}
 
 func (f *Filter) Process(s []Sample) {
-	f.in.Process(s)
-	freq := f.freq.Process()
+	f.process(s, nil, nil)
+}
 
-	avg, buf, bufp := f.avg, f.buf, f.bufp
-	n, lastFreq := filterBufferLength(freq[0]), freq[0]
-	for i := range s {
-		// Recompute n if freq has changed.
-		if freq[i] != lastFreq {
-			n, lastFreq = filterBufferLength(freq[i]), freq[i]
+func (f *Filter) ProcessMulti(b [][]Sample) {
+	f.process(b[0], b[1], b[2])
+}
+
+// process implements the trapezoidal state-variable filter
+// described by Andrew Simper in "Linear Trap Integrated SVF".
+// It is stable at all cutoff frequencies and resonances.
+func (f *Filter) process(lp, bp, hp []Sample) {
+	f.in.Process(lp)
+	freq, res := f.freq.Process(), f.res.Process()
+	ic1, ic2 := f.ic1, f.ic2
+	for i, v0 := range lp {
+		if !f.ok || freq[i] != f.lastFreq || res[i] != f.lastRes {
+			f.coefficients(freq[i], res[i])
+		}
+		v3 := v0 - ic2
+		v1 := f.a1*ic1 + f.a2*v3
+		v2 := ic2 + f.a2*ic1 + f.a3*v3
+		ic1 = 2*v1 - ic1
+		ic2 = 2*v2 - ic2
+		lp[i] = v2
+		if bp != nil {
+			bp[i] = v1
+			hp[i] = v0 - f.k*v1 - v2
 		}
-		// Add current sample and subtract last sample.
-		cur := s[i] / Sample(n)
-		avg += cur - buf[bufp]
-		// Replace last sample in buffer with current sample.
-		buf[bufp] = cur
-		// Bump buffer pointer.
-		bufp++
-		bufp %= int(n)
-		// Use rolling average as output.
-		s[i] = avg
 	}
-	f.avg, f.buf, f.bufp = avg, buf, bufp
+	f.ic1, f.ic2 = ic1, ic2
 }
 
-func filterBufferLength(freq Sample) Sample {
-	s := Sample(waveHz / sampleToHz(freq))
-	if s >= maxFilterBufferLength {
-		return maxFilterBufferLength
+func (f *Filter) coefficients(freq, res Sample) {
+	f.lastFreq, f.lastRes, f.ok = freq, res, true
+	rate := float64(f.c.SampleRate)
+	hz := sampleToHz(freq)
+	if max := rate * 0.49; hz > max {
+		hz = max
 	}
-	if s < 0 {
-		return 0
+	if res < 0 {
+		res = 0
+	} else if res > 0.99 {
+		res = 0.99
 	}
-	return s
-
+	g := Sample(math.Tan(math.Pi * hz / rate))
+	f.k = 2 - 2*res
+	f.a1 = 1 / (1 + g*(g+f.k))
+	f.a2 = g * f.a1
+	f.a3 = g * f.a2
 }
@@ -0,0 +1,69 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// queue is a lock-free queue of functions, with any number of producers
+// and a single consumer. It is used to pass graph mutations to the audio
+// thread without making the audio thread wait on a lock.
+//
+// Producers push batches onto a linked stack with compare-and-swap;
+// the consumer takes the whole stack with a single swap.
+type queue struct {
+	head unsafe.Pointer // *batch
+}
+
+type batch struct {
+	fs   []func()
+	next *batch
+}
+
+// push adds a batch of functions to the queue.
+// The functions in a batch are always run together, in order.
+func (q *queue) push(fs []func()) {
+	b := &batch{fs: fs}
+	for {
+		head := atomic.LoadPointer(&q.head)
+		b.next = (*batch)(head)
+		if atomic.CompareAndSwapPointer(&q.head, head, unsafe.Pointer(b)) {
+			return
+		}
+	}
+}
+
+// run calls all queued functions in the order they were pushed.
+// It must only be called by the consumer.
+func (q *queue) run() {
+	b := (*batch)(atomic.SwapPointer(&q.head, nil))
+	if b == nil {
+		return
+	}
+	// The stack holds the most recent batch first; reverse it in place.
+	var prev *batch
+	for b != nil {
+		b.next, prev, b = prev, b, b.next
+	}
+	for b = prev; b != nil; b = b.next {
+		for _, f := range b.fs {
+			f()
+		}
+	}
+}
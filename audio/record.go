@@ -0,0 +1,159 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nf/sigourney/wav"
+)
+
+// recordSlack is the amount of audio, in seconds, that a Recorder buffers
+// while waiting for the disk. Frames beyond that are dropped.
+const recordSlack = 2
+
+// recordCloseTimeout is how long Close waits for the audio thread to
+// detach the Recorder before finalizing the file without it, in case
+// the Backend has stopped pulling frames.
+var recordCloseTimeout = time.Second
+
+// A Recorder writes the output of a running Engine to a WAV file,
+// exactly as it is delivered to the Engine's Backend.
+//
+// The audio thread never waits for the disk: it copies each frame into a
+// free buffer and hands it to a separate goroutine that does the writing.
+// If the writer falls so far behind that no buffer is free, the frame is
+// dropped and counted instead.
+type Recorder struct {
+	e    *Engine
+	w    *wavWriter
+	free chan []Sample // Empty buffers, for the audio thread.
+	full chan []Sample // Frames waiting to be written.
+	stop chan bool     // Closed to finalize without waiting for full to close.
+	done chan error
+
+	dropped int64 // Sample frames dropped; accessed atomically.
+}
+
+// Record starts recording the Engine's output to the named WAV file,
+// in the given sample format. Recording continues, including while the
+// Engine is stopped and restarted, until the Recorder is closed.
+// Record and Close must not be called concurrently with Start or Stop.
+func (e *Engine) Record(name string, f wav.Format) (*Recorder, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := wav.NewEncoder(file, f, e.c.SampleRate, len(e.in))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	n := recordSlack*e.c.SampleRate/e.c.FrameLength + 1
+	r := &Recorder{
+		e:    e,
+		w:    &wavWriter{f: file, e: enc},
+		free: make(chan []Sample, n),
+		full: make(chan []Sample, n),
+		stop: make(chan bool),
+		done: make(chan error, 1),
+	}
+	for i := 0; i < n; i++ {
+		r.free <- make([]Sample, len(e.out))
+	}
+	go r.write()
+	e.audioDo(func() { e.rec = r })
+	return r, nil
+}
+
+// Close stops recording and finalizes the WAV file.
+// If the Engine is running but its Backend has stopped pulling frames,
+// Close gives up waiting for the audio thread after recordCloseTimeout
+// and writes out the frames recorded so far.
+func (r *Recorder) Close() error {
+	e := r.e
+	e.audioDo(func() {
+		if e.rec == r {
+			e.rec = nil
+		}
+		close(r.full)
+	})
+	select {
+	case err := <-r.done:
+		return err
+	case <-time.After(recordCloseTimeout):
+		close(r.stop)
+		return <-r.done
+	}
+}
+
+// Dropped returns the number of sample frames that were left out
+// of the recording because the disk could not keep up.
+func (r *Recorder) Dropped() int {
+	return int(atomic.LoadInt64(&r.dropped))
+}
+
+// record passes a frame to the writer. It is called by the audio thread.
+func (r *Recorder) record(s []Sample) {
+	select {
+	case b := <-r.free:
+		copy(b, s)
+		r.full <- b // Never blocks; full has room for every buffer.
+	default:
+		atomic.AddInt64(&r.dropped, int64(len(s)/len(r.e.in)))
+	}
+}
+
+// write writes frames to disk until the Recorder is closed.
+// If stop is closed first, it writes the frames already waiting.
+func (r *Recorder) write() {
+	var err error
+	writeFrame := func(b []Sample) {
+		if err == nil {
+			err = r.w.WriteFrame(b)
+		}
+		r.free <- b
+	}
+loop:
+	for {
+		select {
+		case b, ok := <-r.full:
+			if !ok {
+				break loop
+			}
+			writeFrame(b)
+		case <-r.stop:
+			for {
+				select {
+				case b, ok := <-r.full:
+					if !ok {
+						break loop
+					}
+					writeFrame(b)
+				default:
+					break loop
+				}
+			}
+		}
+	}
+	if err2 := r.w.Close(); err == nil {
+		err = err2
+	}
+	r.done <- err
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KindInfo describes a kind of module.
+type KindInfo struct {
+	Doc string // A short description, for display in the user interface.
+
+	// Inputs describes the kind's inputs. Numbered inputs, such as
+	// those of the sequencer, share the entry for their common prefix.
+	Inputs map[string]InputInfo
+
+	// Go is a Go expression that creates a module of the kind, such as
+	// "audio.NewSin()", and Import is the import path of the package
+	// it refers to. They are used to generate Go code from patches.
+	Go, Import string
+}
+
+// Input returns the description of the named input.
+func (k KindInfo) Input(name string) (InputInfo, bool) {
+	in, ok := k.Inputs[strings.Trim(name, "0123456789")]
+	return in, ok
+}
+
+// InputInfo describes an input of a kind of module.
+// An input with nothing connected to it always reads 0.
+type InputInfo struct {
+	Unit string `json:",omitempty"` // Such as "0.1/oct" or "s".
+	Doc  string `json:",omitempty"`
+
+	// Min and Max bound the values that make sense for the input.
+	// If both are zero the input is unbounded.
+	Min, Max float64
+
+	// Default is a sensible starting value for a control
+	// connected to the input.
+	Default float64
+
+	// Curve suggests how a control should map its travel to values
+	// between Min and Max: Linear (the default) or Exponential.
+	Curve string `json:",omitempty"`
+}
+
+// Check returns an error if v is outside the bounds of the input.
+func (in InputInfo) Check(v float64) error {
+	if (in.Min != 0 || in.Max != 0) && (v < in.Min || v > in.Max) {
+		return fmt.Errorf("%v is outside the range %v to %v", v, in.Min, in.Max)
+	}
+	return nil
+}
+
+// Values for InputInfo.Curve.
+const (
+	Linear      = ""
+	Exponential = "exp"
+)
+
+type kind struct {
+	new  func() Processor
+	info KindInfo
+}
+
+var (
+	kindsMu sync.Mutex
+	kinds   = make(map[string]kind)
+)
+
+// Register makes a kind of module available by name.
+// The new function is called to create each module of that kind.
+// Register is typically called from the init function of the package
+// that implements the module. It panics if the kind is already registered.
+func Register(name string, new func() Processor, info KindInfo) {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	if new == nil {
+		panic("audio: Register of nil constructor for kind " + name)
+	}
+	if _, dup := kinds[name]; dup {
+		panic("audio: Register called twice for kind " + name)
+	}
+	kinds[name] = kind{new, info}
+}
+
+// Kinds returns the sorted names of the registered kinds.
+func Kinds() []string {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	var a []string
+	for name := range kinds {
+		a = append(a, name)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// LookupKind returns the description of the named kind.
+func LookupKind(name string) (KindInfo, bool) {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	k, ok := kinds[name]
+	return k.info, ok
+}
+
+// NewKind creates a new module of the named kind.
+func NewKind(name string) (Processor, error) {
+	kindsMu.Lock()
+	k, ok := kinds[name]
+	kindsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("audio: unknown kind %q", name)
+	}
+	return k.new(), nil
+}
+
+// Descriptions of inputs shared by several kinds.
+var (
+	pitchInput = InputInfo{Unit: "0.1/oct", Doc: "pitch; 0 == 440Hz", Min: -2, Max: 1}
+	syncInput  = InputInfo{Doc: "trigger; restarts the waveform"}
+	trigInput  = InputInfo{Doc: "trigger; fires when the input rises above 0.5", Min: -1, Max: 1, Default: 1}
+	audioInput = InputInfo{Doc: "input signal"}
+	levelInput = InputInfo{Unit: "0.01/dB", Min: -1, Max: 0}
+	ratioInput = InputInfo{Doc: "compression ratio; below 1 means limiting", Min: 0, Max: 20, Default: 4}
+	attInput   = InputInfo{Unit: "s", Doc: "attack time", Min: 0, Max: 1, Default: 0.005, Curve: Exponential}
+	relInput   = InputInfo{Unit: "s", Doc: "release time; 0 == 0.1s", Min: 0, Max: 2, Default: 0.1, Curve: Exponential}
+
+	oscInputs = map[string]InputInfo{"pitch": pitchInput, "syn": syncInput}
+)
+
+var engineInfo = KindInfo{
+	Doc: "the audio output, through a limiter",
+	Inputs: map[string]InputInfo{
+		"in":     {Doc: "output signal", Min: -1, Max: 1},
+		"thresh": withDoc(levelInput, "limiter threshold; 0 == 0dBFS"),
+		"ratio":  {Doc: ratioInput.Doc, Min: ratioInput.Min, Max: ratioInput.Max},
+		"att":    attInput,
+		"rel":    relInput,
+		"ceil":   withDoc(levelInput, "output ceiling; 0 == 0dBFS"),
+	},
+}
+
+// KindInfo returns a description of the Engine as a kind of module.
+func (e *Engine) KindInfo() KindInfo {
+	return engineInfo
+}
+
+func withDoc(in InputInfo, doc string) InputInfo {
+	in.Doc = doc
+	return in
+}
+
+func init() {
+	for _, k := range []struct {
+		name string
+		new  func() Processor
+		info KindInfo
+	}{
+		{"adsr", func() Processor { return NewADSR() }, KindInfo{
+			Doc: "attack/decay/sustain/release envelope",
+			Inputs: map[string]InputInfo{
+				"gate":  {Doc: "held above 0.5 to attack and sustain; releases when it falls", Min: 0, Max: 1},
+				"trig":  withDoc(trigInput, "trigger; restarts the attack"),
+				"att":   {Unit: "s", Doc: "attack time", Min: 0, Max: 10, Default: 0.01, Curve: Exponential},
+				"dec":   {Unit: "s", Doc: "decay time", Min: 0, Max: 10, Default: 0.2, Curve: Exponential},
+				"sus":   {Doc: "sustain level", Min: 0, Max: 1, Default: 0.7},
+				"rel":   {Unit: "s", Doc: "release time", Min: 0, Max: 10, Default: 0.5, Curve: Exponential},
+				"curve": {Doc: "shape of each stage; 0 == linear, 1 == exponential, -1 == logarithmic", Min: -1, Max: 1},
+			},
+			Go: "audio.NewADSR()",
+		}},
+		{"clip", func() Processor { return NewClip() }, KindInfo{
+			Doc:    "clips its input to the range -1 to +1",
+			Inputs: map[string]InputInfo{"in": audioInput},
+			Go:     "audio.NewClip()",
+		}},
+		{"compressor", func() Processor { return NewCompressor() }, KindInfo{
+			Doc: "reduces dynamic range",
+			Inputs: map[string]InputInfo{
+				"in":     audioInput,
+				"thresh": withDoc(levelInput, "threshold; 0 == 0dBFS"),
+				"ratio":  ratioInput,
+				"att":    attInput,
+				"rel":    relInput,
+				"gain":   {Unit: "0.01/dB", Doc: "make-up gain; 0 == unity", Min: -1, Max: 1},
+			},
+			Go: "audio.NewCompressor()",
+		}},
+		{"delay", func() Processor { return NewDelay() }, KindInfo{
+			Doc: "delays its input by up to one second",
+			Inputs: map[string]InputInfo{
+				"in":  audioInput,
+				"len": {Unit: "s", Doc: "delay time; less than one frame means no delay", Min: 0, Max: 1, Default: 0.25},
+			},
+			Go: "audio.NewDelay()",
+		}},
+		{"delayline", func() Processor { return NewDelayLine() }, KindInfo{
+			Doc: "smoothly variable delay, with feedback, of up to its maximum; one second by default",
+			Inputs: map[string]InputInfo{
+				"in":     audioInput,
+				"len":    {Unit: "s", Doc: "delay time; limited to the maximum", Min: 0, Max: LongestDelay, Default: 0.25, Curve: Exponential},
+				"fb":     {Doc: "feedback gain", Min: -1, Max: 1, Default: 0.5},
+				"dry":    {Doc: "input's share of the output; 0 == delayed signal only", Min: 0, Max: 1},
+				"interp": {Unit: "0.1/mode", Doc: "interpolation; 0 == linear, 0.1 == allpass, 0.2 == cubic", Min: 0, Max: 0.2},
+			},
+			Go: "audio.NewDelayLine()",
+		}},
+		{"env", func() Processor { return NewEnv() }, KindInfo{
+			Doc: "attack/decay envelope",
+			Inputs: map[string]InputInfo{
+				"gate": {Doc: "level followed by the envelope", Min: 0, Max: 1},
+				"trig": withDoc(trigInput, "trigger; starts an attack to 1"),
+				"att":  {Unit: "10s", Doc: "time to rise by 1; 0.1 == 1s", Min: 0, Max: 1, Default: 0.001, Curve: Exponential},
+				"dec":  {Unit: "10s", Doc: "time to fall by 1; 0.1 == 1s", Min: 0, Max: 1, Default: 0.02, Curve: Exponential},
+			},
+			Go: "audio.NewEnv()",
+		}},
+		{"filter", func() Processor { return NewFilter() }, KindInfo{
+			Doc: "resonant low/band/high-pass filter",
+			Inputs: map[string]InputInfo{
+				"in":   audioInput,
+				"freq": withDoc(pitchInput, "cutoff frequency; 0 == 440Hz"),
+				"res":  {Doc: "resonance", Min: 0, Max: 1, Default: 0.5},
+			},
+			Go: "audio.NewFilter()",
+		}},
+		{"mul", func() Processor { return NewMul() }, KindInfo{
+			Doc:    "multiplies its inputs",
+			Inputs: map[string]InputInfo{"a": {}, "b": {}},
+			Go:     "audio.NewMul()",
+		}},
+		{"noise", func() Processor { return NewNoise() }, KindInfo{Doc: "white noise", Go: "audio.NewNoise()"}},
+		{"quant", func() Processor { return NewQuant() }, KindInfo{
+			Doc:    "quantizes its input to semitones",
+			Inputs: map[string]InputInfo{"in": pitchInput},
+			Go:     "audio.NewQuant()",
+		}},
+		{"rand", func() Processor { return NewRand() }, KindInfo{
+			Doc: "random value between min and max on each trigger",
+			Inputs: map[string]InputInfo{
+				"min":  {Doc: "lowest value"},
+				"max":  {Doc: "highest value", Default: 1},
+				"trig": trigInput,
+			},
+			Go: "audio.NewRand()",
+		}},
+		{"reverb", func() Processor { return NewReverb() }, KindInfo{
+			Doc: "room reverberation",
+			Inputs: map[string]InputInfo{
+				"in":   audioInput,
+				"size": {Doc: "room size; larger rooms reverberate longer", Min: 0, Max: 1, Default: 0.5},
+				"damp": {Doc: "damping of high frequencies", Min: 0, Max: 1, Default: 0.5},
+				"pre":  {Unit: "s", Doc: "pre-delay", Min: 0, Max: reverbMaxPre, Default: 0.02},
+				"mix":  {Doc: "reverberation's share of the output; 0 == input only", Min: 0, Max: 1, Default: 0.3},
+			},
+			Go: "audio.NewReverb()",
+		}},
+		{"sampler", func() Processor { return NewSampler() }, KindInfo{
+			Doc: "plays a WAV file on each trigger",
+			Inputs: map[string]InputInfo{
+				"trig":  withDoc(trigInput, "trigger; plays from the start"),
+				"pitch": {Unit: "0.1/oct", Doc: "transposition; 0 == recorded pitch", Min: -1, Max: 1},
+				"start": {Doc: "start, as a fraction of the sound's length", Min: 0, Max: 1},
+				"end":   {Doc: "end, as a fraction of the sound's length; 0 == the end", Min: 0, Max: 1},
+				"loop":  {Doc: "held above 0.5 to repeat between start and end", Min: 0, Max: 1},
+			},
+			Go: "audio.NewSampler()",
+		}},
+		{"saw", func() Processor { return NewBandLimitedSaw() }, KindInfo{Doc: "band-limited sawtooth oscillator", Inputs: oscInputs, Go: "audio.NewBandLimitedSaw()"}},
+		{"sequencer", func() Processor { return NewStep() }, KindInfo{
+			Doc: "steps through its inputs on each trigger",
+			Inputs: map[string]InputInfo{
+				"trig": withDoc(trigInput, "trigger; advances to the next step"),
+				"rst":  withDoc(trigInput, "trigger; returns to the first step"),
+				"len":  {Unit: "0.01/step", Doc: "number of steps played; 0 == all", Min: 0, Max: MaxSteps / 100.0},
+				"dir":  {Unit: "0.1/mode", Doc: "direction; 0 == forward, 0.1 == backward, 0.2 == pendulum, 0.3 == random", Min: 0, Max: 0.3},
+				"v":    {Doc: "value of each step"},
+				"mode": {Unit: "0.1/mode", Doc: "mode of each step; 0 == play, 0.1 == rest, 0.2 == skip", Min: 0, Max: 0.2},
+			},
+			Go: "audio.NewStep()",
+		}},
+		{"sin", func() Processor { return NewSin() }, KindInfo{Doc: "sine oscillator", Inputs: oscInputs, Go: "audio.NewSin()"}},
+		{"skip", func() Processor { return NewSkip() }, KindInfo{
+			Doc: "passes every nth trigger",
+			Inputs: map[string]InputInfo{
+				"num":  {Unit: "0.1/step", Doc: "n; 0.1 passes every trigger", Min: 0, Max: 2, Default: 0.2},
+				"trig": trigInput,
+			},
+			Go: "audio.NewSkip()",
+		}},
+		{"square", func() Processor { return NewBandLimitedSquare() }, KindInfo{Doc: "band-limited square oscillator", Inputs: oscInputs, Go: "audio.NewBandLimitedSquare()"}},
+		{"sum", func() Processor { return NewSum() }, KindInfo{
+			Doc:    "adds its inputs",
+			Inputs: map[string]InputInfo{"a": {}, "b": {}},
+			Go:     "audio.NewSum()",
+		}},
+		{"triangle", func() Processor { return NewBandLimitedTriangle() }, KindInfo{Doc: "band-limited triangle oscillator", Inputs: oscInputs, Go: "audio.NewBandLimitedTriangle()"}},
+		{"value", func() Processor { return Value(0) }, KindInfo{Doc: "a constant value", Go: "audio.Value(0)"}},
+	} {
+		k.info.Import = "github.com/nf/sigourney/audio"
+		Register(k.name, k.new, k.info)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+// The reverb follows Jezar's Freeverb: eight damped comb filters in
+// parallel, followed by four allpass filters in series. The delays
+// of each, in samples at 44100Hz, are chosen to avoid common factors.
+var (
+	reverbCombs     = [...]int{1116, 1188, 1277, 1356, 1422, 1491, 1557, 1617}
+	reverbAllpasses = [...]int{556, 441, 341, 225}
+)
+
+const (
+	reverbGain    = 0.015 // Gain of the input to the combs.
+	reverbWet     = 3     // Gain of the reverberation.
+	reverbMaxPre  = 0.5   // Longest pre-delay, in seconds.
+	reverbRoom    = 0.28  // Comb feedback added by the size input.
+	reverbMinRoom = 0.7   // Comb feedback at size 0.
+	reverbDamp    = 0.4   // Comb damping at damp 1.
+)
+
+func NewReverb() *Reverb {
+	r := &Reverb{}
+	r.inputs("in", &r.in, "size", &r.size, "damp", &r.damp, "pre", &r.pre, "mix", &r.mix)
+	r.Configure(defaultConfig)
+	return r
+}
+
+// Reverb simulates the reverberation of a room.
+//
+// The size input, from 0 to 1, sets how long the reverberation lasts,
+// and the damp input, from 0 to 1, how quickly its high frequencies
+// die away. The pre input delays the reverberation by up to half a
+// second. The mix input sets the proportion of reverberation in the
+// output: 0 gives only the input, and 1 only the reverberation.
+type Reverb struct {
+	sink
+	in                   Processor
+	size, damp, pre, mix source
+
+	combs     [len(reverbCombs)]reverbComb
+	allpasses [len(reverbAllpasses)]reverbAllpass
+	pd        []Sample // Pre-delay buffer.
+	pp        int      // Index of the next sample to write to pd.
+}
+
+// Configure implements Configurer by allocating the filters' buffers,
+// whose lengths are scaled to the sample rate.
+func (r *Reverb) Configure(c Config) {
+	r.sink.Configure(c)
+	scale := func(n int) []Sample {
+		n = n * c.SampleRate / waveHz
+		if n < 1 {
+			n = 1
+		}
+		return make([]Sample, n)
+	}
+	for i, n := range reverbCombs {
+		r.combs[i] = reverbComb{buf: scale(n)}
+	}
+	for i, n := range reverbAllpasses {
+		r.allpasses[i] = reverbAllpass{buf: scale(n)}
+	}
+	r.pd, r.pp = make([]Sample, int(reverbMaxPre*float64(c.SampleRate))+1), 0
+}
+
+func (r *Reverb) Process(s []Sample) {
+	r.in.Process(s)
+	size, damp, pre, mix := r.size.Process(), r.damp.Process(), r.pre.Process(), r.mix.Process()
+	rate, n := Sample(r.c.SampleRate), len(r.pd)
+	for i, x := range s {
+		d := int(pre[i] * rate)
+		if d < 0 {
+			d = 0
+		} else if d >= n {
+			d = n - 1
+		}
+		r.pd[r.pp] = x
+		in := r.pd[(r.pp-d+n)%n] * reverbGain
+		if r.pp++; r.pp == n {
+			r.pp = 0
+		}
+
+		fb := clamp01(size[i])*reverbRoom + reverbMinRoom
+		dm := clamp01(damp[i]) * reverbDamp
+		var y Sample
+		for j := range r.combs {
+			y += r.combs[j].process(in, fb, dm)
+		}
+		for j := range r.allpasses {
+			y = r.allpasses[j].process(y)
+		}
+		s[i] = x + mix[i]*(y*reverbWet-x)
+	}
+}
+
+// reverbComb is a comb filter with a low-pass filter in its feedback loop.
+type reverbComb struct {
+	buf   []Sample
+	p     int
+	store Sample // State of the low-pass filter.
+}
+
+func (c *reverbComb) process(x, fb, damp Sample) Sample {
+	y := c.buf[c.p]
+	c.store = y*(1-damp) + c.store*damp
+	c.buf[c.p] = x + c.store*fb
+	if c.p++; c.p == len(c.buf) {
+		c.p = 0
+	}
+	return y
+}
+
+// reverbAllpass is Freeverb's approximation of an allpass filter.
+type reverbAllpass struct {
+	buf []Sample
+	p   int
+}
+
+func (a *reverbAllpass) process(x Sample) Sample {
+	b := a.buf[a.p]
+	a.buf[a.p] = x + b/2
+	if a.p++; a.p == len(a.buf) {
+		a.p = 0
+	}
+	return b - x
+}
+
+func clamp01(v Sample) Sample {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nf/sigourney/fast"
+	"github.com/nf/sigourney/wav"
+)
+
+// SampleDir is the directory from which LoadSound reads WAV files.
+var SampleDir = "samples"
+
+// A Sound is a mono recording, such as a drum hit, played by a Sampler.
+type Sound struct {
+	Rate int // Samples per second.
+	s    []Sample
+}
+
+// LoadSound reads the named WAV file from SampleDir, mixing its
+// channels down to mono. The name must be relative and may not
+// refer to files outside SampleDir.
+func LoadSound(name string) (*Sound, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("audio: bad sound name %q", name)
+	}
+	f, err := os.Open(filepath.Join(SampleDir, clean))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := wav.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	if d.Channels < 1 || d.Rate < 1 {
+		return nil, fmt.Errorf("%v: bad WAV header", name)
+	}
+	snd := &Sound{Rate: d.Rate, s: make([]Sample, len(d.Samples)/d.Channels)}
+	for i := range snd.s {
+		var sum float64
+		for _, v := range d.Samples[i*d.Channels : (i+1)*d.Channels] {
+			sum += v
+		}
+		snd.s[i] = Sample(sum / float64(d.Channels))
+	}
+	return snd, nil
+}
+
+// Len returns the length of the sound in samples.
+func (s *Sound) Len() int {
+	return len(s.s)
+}
+
+// A Player is a Processor that plays a Sound.
+type Player interface {
+	// SetSound replaces the Player's sound. A nil sound is silent.
+	SetSound(s *Sound)
+}
+
+func NewSampler() *Sampler {
+	s := &Sampler{}
+	s.inputs("trig", &s.trig, "pitch", &s.pitch, "start", &s.start, "end", &s.end, "loop", &s.loop)
+	return s
+}
+
+// Sampler plays a Sound from its start each time its trig input fires.
+//
+// The pitch input transposes the sound, in the same units as Sin's:
+// at 0 the sound plays at its recorded speed, and at 0.1 twice as fast.
+// The start and end inputs select the part of the sound to play, as
+// fractions of its length; an end of 0 plays to the end of the sound.
+// While the loop input is above 0.5, playback repeats between start and
+// end; otherwise it stops at the end. The sound is resampled to the
+// engine's rate by cubic interpolation.
+type Sampler struct {
+	sink
+	trig                    trigger
+	pitch, start, end, loop source
+
+	snd     *Sound
+	pos     float64 // Playback position, in samples of snd.
+	playing bool
+}
+
+// SetSound implements Player.
+// It must not be called concurrently with Process.
+func (s *Sampler) SetSound(snd *Sound) {
+	s.snd, s.pos, s.playing = snd, 0, false
+}
+
+func (s *Sampler) Process(out []Sample) {
+	t, pitch, start, end, loop := s.trig.Process(), s.pitch.Process(),
+		s.start.Process(), s.end.Process(), s.loop.Process()
+	if s.snd == nil || len(s.snd.s) == 0 {
+		for i := range out {
+			out[i] = 0
+		}
+		return
+	}
+	n := float64(len(s.snd.s))
+	ratio := float64(s.snd.Rate) / float64(s.c.SampleRate)
+	lastP, step := pitch[0], ratio*fast.Exp2(float64(pitch[0])*10)
+	for i := range out {
+		st := float64(clamp01(start[i])) * n
+		if s.trig.isTrigger(t[i]) {
+			s.pos, s.playing = st, true
+		}
+		if !s.playing {
+			out[i] = 0
+			continue
+		}
+		e := n
+		if v := float64(end[i]); v > 0 && v < 1 {
+			e = v * n
+		}
+		if s.pos >= e {
+			if loop[i] > triggerThreshold && e > st {
+				s.pos = st + math.Mod(s.pos-st, e-st)
+			} else {
+				s.playing = false
+				out[i] = 0
+				continue
+			}
+		}
+		out[i] = s.at(s.pos)
+		if pitch[i] != lastP {
+			lastP, step = pitch[i], ratio*fast.Exp2(float64(pitch[i])*10)
+		}
+		s.pos += step
+	}
+}
+
+// at returns the sound at position p, interpolating between samples.
+func (s *Sampler) at(p float64) Sample {
+	i := int(p)
+	return hermite(s.sample(i-1), s.sample(i), s.sample(i+1), s.sample(i+2), Sample(p-float64(i)))
+}
+
+// sample returns the ith sample of the sound, or 0 outside it.
+func (s *Sampler) sample(i int) Sample {
+	if i < 0 || i >= len(s.snd.s) {
+		return 0
+	}
+	return s.snd.s[i]
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audio
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSteps = 4  // Number of steps of a new Step.
+	MaxSteps     = 64 // Largest number of steps of a Step.
+)
+
+func NewStep() *Step {
+	s := &Step{steps: DefaultSteps, rnd: rand.New(rand.NewSource(1))}
+	s.inputs("trig", &s.trig, "rst", &s.rst, "len", &s.len, "dir", &s.dir,
+		"v", s.v[:], "mode", s.mode[:])
+	return s
+}
+
+// Step is a sequencer. It moves to another of its steps each time its
+// trig input fires, and outputs the value of the current step.
+//
+// Each step has a value input, v0, v1, and so on, and a mode input,
+// mode0, mode1, and so on: 0 plays the step, 0.1 rests on it, keeping
+// the gate output low, and 0.2 skips it. The number of steps is set by
+// SetSteps. The len input plays only the first steps, 0.01 per step,
+// so that sequencers of different lengths may run in polymeter; 0 plays
+// every step. The dir input chooses the direction: 0 forward, 0.1
+// backward, 0.2 pendulum, or 0.3 random. The rst input returns to the
+// first step, or to the last when going backward.
+type Step struct {
+	sink
+	trig, rst trigger
+	len, dir  source
+	v, mode   [MaxSteps]source
+
+	steps int
+	n     int  // Current step.
+	back  bool // Whether a pendulum is heading backward.
+	rnd   *rand.Rand
+}
+
+// Step modes, selected by the mode inputs in steps of 0.1.
+const (
+	stepPlay = iota
+	stepRest
+	stepSkip
+)
+
+// Step directions, selected by the dir input in steps of 0.1.
+const (
+	stepForward = iota
+	stepBackward
+	stepPendulum
+	stepRandom
+)
+
+// The "out" output carries the value of the current step.
+// The "gate" output is high (1) while the trig input is high,
+// unless the current step is a rest.
+var stepOutputs = []string{"out", "gate"}
+
+func (s *Step) Outputs() []string {
+	return stepOutputs
+}
+
+// Seed implements Seeder, for the random direction.
+func (s *Step) Seed(seed int64) {
+	s.rnd.Seed(seed)
+}
+
+// SetSteps sets the number of steps, from 1 to MaxSteps, and so the
+// number of value and mode inputs. Inputs of removed steps are
+// disconnected. It must not be called concurrently with Process.
+//
+// The inputs of every possible step are made by NewStep,
+// so that SetSteps doesn't allocate.
+func (s *Step) SetSteps(n int) {
+	if n < 1 {
+		n = 1
+	} else if n > MaxSteps {
+		n = MaxSteps
+	}
+	for i := n; i < s.steps; i++ {
+		s.v[i].p, s.mode[i].p = Value(0), Value(0)
+	}
+	s.steps = n
+	if s.n >= n {
+		s.n = 0
+	}
+}
+
+// Inputs implements Sink. Only the value and
+// mode inputs of the current steps are listed.
+func (s *Step) Inputs() []string {
+	var a []string
+	for _, name := range s.sink.Inputs() {
+		i, err := strconv.Atoi(strings.TrimLeft(name, "abcdefghijklmnopqrstuvwxyz"))
+		if err != nil || i < s.steps {
+			a = append(a, name)
+		}
+	}
+	return a
+}
+
+func (s *Step) Process(b []Sample) {
+	s.process(b, nil)
+}
+
+func (s *Step) ProcessMulti(b [][]Sample) {
+	s.process(b[0], b[1])
+}
+
+func (s *Step) process(b, gate []Sample) {
+	t, r := s.trig.Process(), s.rst.Process()
+	l, dir := s.len.Process(), s.dir.Process()
+	v, mode := s.v[:s.steps], s.mode[:s.steps]
+	for i := range v {
+		v[i].Process()
+		mode[i].Process()
+	}
+	for i := range b {
+		n, d := s.length(l[i]), int(dir[i]*10+0.5)
+		if s.trig.isTrigger(t[i]) {
+			s.advance(n, d, i)
+		}
+		if s.rst.isTrigger(r[i]) {
+			s.n, s.back = 0, false
+			if d == stepBackward {
+				s.n = n - 1
+			}
+			if stepMode(mode[s.n].b[i]) == stepSkip {
+				s.advance(n, d, i)
+			}
+		}
+		b[i] = v[s.n].b[i]
+		if gate != nil {
+			gate[i] = 0
+			if t[i] > triggerThreshold && stepMode(mode[s.n].b[i]) == stepPlay {
+				gate[i] = 1
+			}
+		}
+	}
+}
+
+// length returns the number of steps played, given the len input.
+func (s *Step) length(l Sample) int {
+	n := int(l*100 + 0.5)
+	if n <= 0 || n > s.steps {
+		return s.steps
+	}
+	return n
+}
+
+func stepMode(m Sample) int {
+	return int(m*10 + 0.5)
+}
+
+// advance moves in direction d to the next of the first n steps that
+// isn't skipped. Moving past a skipped step doesn't return to the
+// current one, as a pendulum would when bouncing off a skipped last
+// step, unless every other step is skipped. The mode inputs are read
+// at sample i.
+func (s *Step) advance(n, d, i int) {
+	k := s.n
+	for try := 0; try < 2*n; try++ {
+		if d >= stepRandom && try > 0 {
+			// Look for the next step that isn't skipped.
+			d = stepForward
+		}
+		k = s.next(k, n, d)
+		if stepMode(s.mode[k].b[i]) != stepSkip && (try == 0 || k != s.n) {
+			s.n = k
+			return
+		}
+	}
+}
+
+// next returns the step after k, of the first n, in direction d.
+func (s *Step) next(k, n, d int) int {
+	switch {
+	case d <= stepForward:
+		if k+1 >= n {
+			return 0
+		}
+		return k + 1
+	case d == stepBackward:
+		if k <= 0 || k > n {
+			return n - 1
+		}
+		return k - 1
+	case d == stepPendulum:
+		if n == 1 {
+			return 0
+		}
+		switch {
+		case k >= n:
+			s.back = true
+			return n - 1
+		case k == n-1:
+			s.back = true
+		case k <= 0:
+			s.back = false
+		}
+		if s.back {
+			return k - 1
+		}
+		return k + 1
+	}
+	return s.rnd.Intn(n)
+}
@@ -46,7 +46,7 @@ func (w *TableOsc) Process(s []Sample) {
 			hz = sampleToHz(s[i])
 		}
 		s[i] = Sample(w.table[int(p)])
-		p += hz / waveHz * float64(len(w.table))
+		p += hz / float64(w.c.SampleRate) * float64(len(w.table))
 		for p > float64(len(w.table)-1) {
 			p -= float64(len(w.table))
 		}
@@ -0,0 +1,39 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/nf/sigourney/lang"
+)
+
+// convert implements the "convert" command, which converts a patch
+// between the JSON and text formats, as chosen by the file names.
+func convert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: sigourney convert in out")
+	}
+	objs, err := lang.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return lang.WriteFile(fs.Arg(1), objs)
+}
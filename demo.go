@@ -17,15 +17,20 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"time"
 
 	"github.com/nf/sigourney/audio"
 )
 
-func demo() error {
-	e := audio.NewEngine()
-	e.Input("in", audio.NewSin())
+func demo(newBackend func() audio.Backend, opts []audio.Option, msg io.Writer) error {
+	e := audio.NewEngine(opts...)
+	e.SetBackend(newBackend())
+	sin := audio.NewSin()
+	sin.Configure(e.Config())
+	e.Input("in", sin)
 	if err := e.Start(); err != nil {
 		return err
 	}
@@ -34,7 +39,8 @@ func demo() error {
 		return err
 	}
 
-	e = audio.NewEngine()
+	e = audio.NewEngine(opts...)
+	e.SetBackend(newBackend())
 
 	sinMod := audio.NewSin()
 	sinMod.Input("pitch", audio.Value(-0.1))
@@ -43,7 +49,7 @@ func demo() error {
 	sinModMul.Input("a", sinMod)
 	sinModMul.Input("b", audio.Value(0.1))
 
-	sin := audio.NewSin()
+	sin = audio.NewSin()
 	sin.Input("pitch", sinModMul)
 
 	envMod := audio.NewSin()
@@ -73,13 +79,20 @@ func demo() error {
 	mulMul.Input("a", mul)
 	mulMul.Input("b", audio.Value(0.5))
 
+	for _, c := range []audio.Configurer{
+		sinMod, sinModMul, sin, envMod, envModMul,
+		envModSum, sin2, env, mul, mulMul,
+	} {
+		c.Configure(e.Config())
+	}
+
 	e.Input("in", mulMul)
 
 	if err := e.Start(); err != nil {
 		return err
 	}
 
-	os.Stdout.Write([]byte("Press enter to stop...\n"))
+	fmt.Fprintln(msg, "Press enter to stop...")
 	os.Stdin.Read([]byte{0})
 
 	return e.Stop()
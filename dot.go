@@ -0,0 +1,56 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/nf/sigourney/lang"
+)
+
+// dot implements the "dot" command, which writes the graph of a saved
+// patch in the DOT language of Graphviz, or draws it as SVG.
+func dot(args []string) error {
+	fs := flag.NewFlagSet("dot", flag.ExitOnError)
+	var (
+		patch = fs.String("patch", "", "patch file to draw")
+		out   = fs.String("o", "", "output file (default standard output)")
+		svg   = fs.Bool("svg", false, "write SVG instead of DOT; requires Graphviz")
+	)
+	fs.Parse(args)
+	if *patch == "" {
+		return errors.New("dot: -patch must be specified")
+	}
+	objs, err := lang.ReadFile(*patch)
+	if err != nil {
+		return err
+	}
+	b := lang.Dot(objs)
+	if *svg {
+		if b, err = lang.SVG(b); err != nil {
+			return err
+		}
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(*out, b, 0644)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/nf/sigourney/gen"
+	"github.com/nf/sigourney/lang"
+)
+
+// genCode implements the "gen" command, which writes Go code that
+// builds a saved patch with the audio package.
+func genCode(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	var (
+		patch = fs.String("patch", "", "patch file to convert")
+		out   = fs.String("o", "", "output Go file (default standard output)")
+		pkg   = fs.String("package", "main", "package name; main includes a main function that plays the patch")
+		fn    = fs.String("func", "Patch", "name of the function that builds the patch")
+	)
+	fs.Parse(args)
+	if *patch == "" {
+		return errors.New("gen: -patch must be specified")
+	}
+	objs, err := lang.ReadFile(*patch)
+	if err != nil {
+		return err
+	}
+	b, err := gen.Source(objs, gen.Options{
+		Package: *pkg,
+		Func:    *fn,
+		Command: "sigourney gen " + strings.Join(args, " "),
+	})
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(*out, b, 0644)
+}
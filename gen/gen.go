@@ -0,0 +1,402 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gen generates Go code that builds the graph of a patch
+// with the audio package, so that it may be used without the user interface.
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/ui"
+)
+
+// Options controls the generated code.
+type Options struct {
+	// Package is the name of the generated package. If it is "main",
+	// the default, a main function that plays the patch is generated too.
+	Package string
+
+	// Func is the name of the generated function, which builds the
+	// patch and connects it to an Engine. The default is "Patch".
+	Func string
+
+	// Command is the command that generated the code,
+	// for the comment at the top of the file.
+	Command string
+}
+
+// Source returns Go source code that builds the patch with the given objects.
+//
+// Each module is created directly with its constructor. A module whose
+// output feeds more than one input, that provides more than one output,
+// or that is part of a feedback loop, is connected through a Dup, as in
+// the user interface. Values are inlined, and random modules are seeded
+// as in the user interface. Modules that don't contribute to the engine's
+// input are left out. If the patch plays files, the generated function
+// loads them from audio.SampleDir and returns an error if it can't.
+// A patch whose engine has numbered inputs, in0, in1, and so on, needs
+// an Engine with as many channels, which the main function creates.
+func Source(objs []*ui.Object, opt Options) ([]byte, error) {
+	if opt.Package == "" {
+		opt.Package = "main"
+	}
+	if opt.Func == "" {
+		opt.Func = "Patch"
+	}
+	g, err := newGenerator(objs)
+	if err != nil {
+		return nil, err
+	}
+	g.source(opt)
+	b, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("gen: formatting generated code: %v", err)
+	}
+	return b, nil
+}
+
+type generator struct {
+	buf bytes.Buffer
+
+	objs    map[string]*ui.Object
+	info    map[string]audio.KindInfo // By kind.
+	names   []string                  // Modules used, in order of name.
+	vars    map[string]string         // Go variables, by object name.
+	dup     map[string]bool           // Modules connected through a Dup.
+	engine  *ui.Object
+	chans   int // Channels needed by the engine's inputs.
+	imports map[string]bool
+}
+
+func newGenerator(objs []*ui.Object) (*generator, error) {
+	g := &generator{
+		objs:    make(map[string]*ui.Object),
+		info:    make(map[string]audio.KindInfo),
+		vars:    make(map[string]string),
+		dup:     make(map[string]bool),
+		imports: map[string]bool{"github.com/nf/sigourney/audio": true},
+	}
+	for _, o := range objs {
+		g.objs[o.Name] = o
+		if o.Kind == "engine" {
+			g.engine = o
+			continue
+		}
+		info, ok := audio.LookupKind(o.Kind)
+		if !ok {
+			return nil, fmt.Errorf("gen: %v: unknown kind %q", o.Name, o.Kind)
+		}
+		if info.Go == "" {
+			return nil, fmt.Errorf("gen: %v: no Go code for kind %q", o.Name, o.Kind)
+		}
+		g.info[o.Kind] = info
+	}
+	if g.engine == nil {
+		return nil, fmt.Errorf("gen: patch has no engine")
+	}
+	// The numbered inputs, one per channel, set the number of channels.
+	g.chans = 1
+	for input := range g.engine.Input {
+		if !strings.HasPrefix(input, "in") {
+			continue
+		}
+		if n, err := strconv.Atoi(input[len("in"):]); err == nil && n >= g.chans {
+			g.chans = n + 1
+		}
+	}
+	inputs := audio.NewEngine(audio.Channels(g.chans)).Inputs()
+	for _, input := range g.engine.SortedInputs() {
+		if i := sort.SearchStrings(inputs, input); i == len(inputs) || inputs[i] != input {
+			return nil, fmt.Errorf("gen: engine has no input %v", input)
+		}
+	}
+
+	// Find the modules that contribute to the engine's input,
+	// and count the inputs each one feeds.
+	uses := make(map[string]int)
+	used := make(map[string]bool)
+	var visit func(o *ui.Object) error
+	visit = func(o *ui.Object) error {
+		for _, input := range o.SortedInputs() {
+			name, output := ui.SplitOutput(o.Input[input])
+			f := g.objs[name]
+			if f == nil {
+				return fmt.Errorf("gen: %v.%v: unknown object %q", o.Name, input, name)
+			}
+			if f.Kind == "value" {
+				continue
+			}
+			uses[name]++
+			if output != "" {
+				g.dup[name] = true
+			}
+			if !used[name] {
+				used[name] = true
+				if err := visit(f); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := visit(g.engine); err != nil {
+		return nil, err
+	}
+	for name := range used {
+		g.names = append(g.names, name)
+		if uses[name] > 1 || g.inCycle(name) {
+			g.dup[name] = true
+		}
+		g.imports[g.info[g.objs[name].Kind].Import] = true
+	}
+	ui.SortNames(g.names)
+
+	// Choose variable names that are valid and distinct.
+	taken := map[string]bool{"e": true, "c": true, "err": true}
+	for path := range g.imports {
+		taken[pkgName(path)] = true
+	}
+	for _, name := range g.names {
+		v := identifier(name)
+		for taken[v] || taken[v+"Dup"] {
+			v += "_"
+		}
+		taken[v], taken[v+"Dup"] = true, true
+		g.vars[name] = v
+	}
+	return g, nil
+}
+
+// inCycle reports whether the named object feeds its own input.
+func (g *generator) inCycle(name string) bool {
+	seen := make(map[string]bool)
+	var reaches func(o *ui.Object) bool
+	reaches = func(o *ui.Object) bool {
+		for _, from := range o.Input {
+			f, _ := ui.SplitOutput(from)
+			if f == name {
+				return true
+			}
+			if !seen[f] && g.objs[f] != nil {
+				seen[f] = true
+				if reaches(g.objs[f]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return reaches(g.objs[name])
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) source(opt Options) {
+	if opt.Command != "" {
+		g.printf("// generated by %q; DO NOT EDIT\n\n", opt.Command)
+	}
+	g.printf("package %v\n\n", opt.Package)
+	main := opt.Package == "main"
+	midi := g.imports["github.com/nf/sigourney/midi"]
+	g.printf("import (\n")
+	if main {
+		g.printf("%q\n%q\n%q\n\n", "fmt", "log", "os")
+		g.printf("%q\n", "github.com/gordonklaus/portaudio")
+		if midi {
+			g.printf("%q\n", "github.com/rakyll/portmidi")
+		}
+		g.printf("\n")
+	}
+	var paths []string
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		g.printf("%q\n", path)
+	}
+	g.printf(")\n\n")
+
+	var files []string
+	for _, name := range g.names {
+		if g.objs[name].File != "" {
+			files = append(files, name)
+		}
+	}
+	g.printf("// %v builds the patch and connects it to the inputs of e", opt.Func)
+	if g.chans > 1 {
+		g.printf(",\n// which must have %d channels", g.chans)
+	}
+	g.printf(".\n")
+	if len(files) > 0 {
+		g.printf("func %v(e *audio.Engine) error {\n", opt.Func)
+	} else {
+		g.printf("func %v(e *audio.Engine) {\n", opt.Func)
+	}
+	for _, name := range g.names {
+		g.printf("%v := %v\n", g.vars[name], g.info[g.objs[name].Kind].Go)
+	}
+	var conf []string
+	for _, name := range g.names {
+		p, err := audio.NewKind(g.objs[name].Kind)
+		if _, ok := p.(audio.Configurer); ok && err == nil {
+			conf = append(conf, g.vars[name])
+		}
+	}
+	if len(conf) > 0 {
+		g.printf("for _, c := range []audio.Configurer{\n%v,\n} {\n", strings.Join(conf, ", "))
+		g.printf("c.Configure(e.Config())\n}\n")
+	}
+	for _, name := range g.names {
+		o := g.objs[name]
+		if p, err := audio.NewKind(o.Kind); err == nil {
+			if _, ok := p.(audio.Seeder); ok {
+				seed := o.Seed
+				if seed == 0 {
+					seed = ui.DefaultSeed(name)
+				}
+				g.printf("%v.Seed(%d)\n", g.vars[name], seed)
+			}
+			if _, ok := p.(audio.Stepper); ok && o.Steps != 0 && o.Steps != audio.DefaultSteps {
+				g.printf("%v.SetSteps(%d)\n", g.vars[name], o.Steps)
+			}
+			if _, ok := p.(audio.Delayer); ok && o.MaxDelay != 0 && o.MaxDelay != audio.DefaultMaxDelay {
+				g.printf("%v.SetMaxDelay(%v)()\n", g.vars[name], strconv.FormatFloat(o.MaxDelay, 'g', -1, 64))
+			}
+		}
+	}
+	if len(files) > 0 {
+		g.printf("for _, s := range []struct {\np audio.Player\nfile string\n}{\n")
+		for _, name := range files {
+			g.printf("{%v, %q},\n", g.vars[name], g.objs[name].File)
+		}
+		g.printf("} {\nsnd, err := audio.LoadSound(s.file)\nif err != nil {\nreturn err\n}\ns.p.SetSound(snd)\n}\n")
+	}
+	if len(g.dup) > 0 {
+		g.printf("\n")
+	}
+	for _, name := range g.names {
+		if g.dup[name] {
+			g.printf("%vDup := audio.NewDup(%[1]v)\ne.AddTicker(%[1]vDup)\n", g.vars[name])
+		}
+	}
+	for _, name := range g.names {
+		g.connect(g.vars[name], g.objs[name])
+	}
+	g.connect("e", g.engine)
+	if len(files) > 0 {
+		g.printf("return nil\n")
+	}
+	g.printf("}\n")
+
+	if main {
+		call := opt.Func + "(e)"
+		if len(files) > 0 {
+			call = fmt.Sprintf("if err := %v; err != nil {\nlog.Fatal(err)\n}", call)
+		}
+		g.printf(`
+func main() {
+	portaudio.Initialize()
+	defer portaudio.Terminate()
+`)
+		if midi {
+			g.printf("portmidi.Initialize()\ndefer portmidi.Terminate()\n")
+		}
+		opts := ""
+		if g.chans > 1 {
+			opts = fmt.Sprintf("audio.Channels(%d)", g.chans)
+		}
+		g.printf(`
+	e := audio.NewEngine(%v)
+	%v
+	if err := e.Start(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Press enter to stop...")
+	os.Stdin.Read([]byte{0})
+	if err := e.Stop(); err != nil {
+		log.Fatal(err)
+	}
+}
+`, opts, call)
+	}
+}
+
+// connect generates the code that connects the inputs of o,
+// whose variable is v.
+func (g *generator) connect(v string, o *ui.Object) {
+	inputs := o.SortedInputs()
+	if len(inputs) > 0 {
+		g.printf("\n")
+	}
+	for _, input := range inputs {
+		g.printf("%v.Input(%q, %v)\n", v, input, g.expr(o.Input[input]))
+	}
+}
+
+// expr returns the Go expression for the connection source from.
+func (g *generator) expr(from string) string {
+	name, output := ui.SplitOutput(from)
+	f := g.objs[name]
+	if f.Kind == "value" {
+		return "audio.Value(" + strconv.FormatFloat(f.Value, 'g', -1, 64) + ")"
+	}
+	v := g.vars[name]
+	if !g.dup[name] {
+		return v
+	}
+	if output == "" {
+		return v + "Dup.Output()"
+	}
+	p, _ := audio.NewKind(f.Kind)
+	if m, ok := p.(audio.MultiProcessor); ok {
+		for i, out := range m.Outputs() {
+			if out == output && i > 0 {
+				return fmt.Sprintf("%vDup.OutputN(%d)", v, i)
+			}
+		}
+	}
+	return v + "Dup.Output()"
+}
+
+// identifier returns a Go identifier based on name.
+func identifier(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || i > 0 && '0' <= c && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	s := string(b)
+	if s == "" || token.Lookup(s).IsKeyword() {
+		s += "_"
+	}
+	return s
+}
+
+func pkgName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/lang"
+	"github.com/nf/sigourney/ui"
+)
+
+// The source importer is shared by the tests, as loading
+// the audio package and its dependencies is slow.
+var (
+	fset = token.NewFileSet()
+	imp  = importer.ForCompiler(fset, "source", nil)
+)
+
+// typecheck reports an error if src isn't a valid Go source file
+// that type-checks against the packages it imports.
+func typecheck(t *testing.T, src []byte) {
+	f, err := parser.ParseFile(fset, "patch.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatalf("generated code doesn't parse: %v\n%s", err, src)
+	}
+	conf := types.Config{Importer: imp}
+	if _, err := conf.Check(f.Name.Name, fset, []*ast.File{f}, nil); err != nil {
+		t.Errorf("generated code doesn't type-check: %v\n%s", err, src)
+	}
+}
+
+const renderMain = `package main
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/nf/sigourney/audio"
+)
+
+func main() {
+	e := audio.NewEngine()
+	Build(e)
+	binary.Write(os.Stdout, binary.LittleEndian, e.Render(%d))
+}
+`
+
+// run builds and runs src, which must be a package whose Build function
+// takes an *audio.Engine, and returns the first frames the Engine renders.
+func run(t *testing.T, src []byte, frames int) []audio.Sample {
+	gotool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	dir, err := ioutil.TempDir("", "gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := parser.ParseFile(token.NewFileSet(), "patch.go", src, parser.PackageClauseOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src = bytes.Replace(src, []byte("package "+f.Name.Name+"\n"), []byte("package main\n"), 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "patch.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := []byte(fmt.Sprintf(renderMain, frames))
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), main, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(gotool, "run", "patch.go", "main.go")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running generated code: %v", err)
+	}
+	s := make([]audio.Sample, len(out)/8)
+	if err := binary.Read(bytes.NewReader(out), binary.LittleEndian, s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+type discard struct{}
+
+func (discard) Hello(map[string]*ui.Kind) {}
+func (discard) SetGraph([]*ui.Object)     {}
+
+func TestSource(t *testing.T) {
+	const patch = `
+lfo = sin(pitch: -0.5)
+seq = sequencer(trig: lfo, v0: 0.1, v5: lfo, steps: 6)
+osc = sin(pitch: seq)
+engine.in = osc * seq.gate + lfo * 0.1 + rand(trig: lfo, seed: 5)
+unused = noise()
+`
+	objs, err := lang.Objects("test", []byte(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Source(objs, Options{Package: "patch", Func: "Build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	typecheck(t, b)
+	src := string(b)
+	for _, want := range []string{
+		"package patch\n",
+		"func Build(e *audio.Engine) {\n",
+		// lfo feeds two inputs, and the sequencer's second output
+		// is used, so both go through a Dup.
+		"lfoDup := audio.NewDup(lfo)\n",
+		"e.AddTicker(lfoDup)\n",
+		`seq.Input("trig", lfoDup.Output())`,
+		`mul5.Input("b", seqDup.OutputN(1))`,
+		// osc feeds just one input, and values are inlined.
+		`mul5.Input("a", osc)`,
+		`seq.Input("v0", audio.Value(0.1))`,
+		`e.Input("in", sum3)`,
+		"rand8.Seed(5)\n",
+		"seq.SetSteps(6)\n",
+		`seq.Input("v5", lfoDup.Output())`,
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("generated code lacks %q:\n%s", want, src)
+		}
+	}
+	for _, bad := range []string{"oscDup", "unused", "func main"} {
+		if strings.Contains(src, bad) {
+			t.Errorf("generated code contains %q:\n%s", bad, src)
+		}
+	}
+
+	// The generated graph must sound the same as the patch does in the UI.
+	if testing.Short() {
+		t.Skip("skipping run of generated code in short mode")
+	}
+	const frames = 20
+	u := ui.New(discard{})
+	if err := u.LoadObjects(objs, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := u.Render(frames)
+	got := run(t, b, frames)
+	if len(got) != len(want) {
+		t.Fatalf("generated code rendered %d samples, want %d", len(got), len(want))
+	}
+	var peak float64
+	for i := range got {
+		peak = math.Max(peak, math.Abs(float64(want[i])))
+		if math.Abs(float64(got[i]-want[i])) > 1e-9 {
+			t.Fatalf("sample %d of generated code is %v, want %v", i, got[i], want[i])
+		}
+	}
+	if peak == 0 {
+		t.Error("patch is silent")
+	}
+}
+
+func TestSourceChannels(t *testing.T) {
+	objs, err := lang.Objects("test", []byte("engine.in0 = sin()\nengine.in1 = sin(pitch: 0.1)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Source(objs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	typecheck(t, b)
+	src := string(b)
+	for _, want := range []string{
+		"// which must have 2 channels.\n",
+		"e := audio.NewEngine(audio.Channels(2))\n",
+		`e.Input("in0", sin1)`,
+		`e.Input("in1", sin2)`,
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("generated code lacks %q:\n%s", want, src)
+		}
+	}
+
+	for _, o := range objs {
+		if o.Kind == "engine" {
+			o.Input["out"] = o.Input["in0"]
+		}
+	}
+	if _, err := Source(objs, Options{}); err == nil {
+		t.Error("Source of patch with engine input out succeeded")
+	}
+}
+
+func TestSourceLimiter(t *testing.T) {
+	objs, err := lang.Objects("test", []byte("engine.in = sin()\nengine.thresh = -0.1\nengine.ceil = sin(pitch: -0.5)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Source(objs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	typecheck(t, b)
+	src := string(b)
+	for _, want := range []string{
+		"e := audio.NewEngine()\n",
+		`e.Input("in", sin1)`,
+		`e.Input("thresh", audio.Value(-0.1))`,
+		`e.Input("ceil", sin3)`,
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("generated code lacks %q:\n%s", want, src)
+		}
+	}
+}
+
+func TestSourceFiles(t *testing.T) {
+	objs, err := lang.Objects("test", []byte(`engine.in = sampler(trig: sin(), file: "kick.wav")`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Source(objs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	typecheck(t, b)
+	src := string(b)
+	for _, want := range []string{
+		"func Patch(e *audio.Engine) error {\n",
+		`{sampler1, "kick.wav"},`,
+		"snd, err := audio.LoadSound(s.file)\n",
+		"return nil\n}\n",
+		"if err := Patch(e); err != nil {\n",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("generated code lacks %q:\n%s", want, src)
+		}
+	}
+}
+
+func TestSourceMaxDelay(t *testing.T) {
+	objs, err := lang.Objects("test", []byte(`engine.in = delayline(in: sin(), len: 4, max: 4.5)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Source(objs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The maximum delay is set after Configure, which sizes the buffer
+	// for the engine's sample rate.
+	typecheck(t, b)
+	src := string(b)
+	conf, set := strings.Index(src, "c.Configure(e.Config())"), strings.Index(src, "delayline1.SetMaxDelay(4.5)()\n")
+	if conf < 0 || set < conf {
+		t.Errorf("generated code doesn't set the maximum delay after Configure:\n%s", src)
+	}
+}
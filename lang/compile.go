@@ -0,0 +1,462 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lang
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/scanner"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/ui"
+)
+
+type compiler struct {
+	objs  map[string]*ui.Object
+	order []*ui.Object // In order of creation.
+	defs  map[string]*stmt
+
+	aliases   map[string]string // Sources of names that aren't objects.
+	resolving map[string]bool   // Aliases being resolved; see alias.
+	kinds     map[string]*kind
+
+	next int // Suffix of the next generated name.
+}
+
+// compile compiles the statements of a patch into its objects.
+func compile(ss []*stmt) (objs []*ui.Object, err error) {
+	c := &compiler{
+		objs:      make(map[string]*ui.Object),
+		defs:      make(map[string]*stmt),
+		aliases:   make(map[string]string),
+		resolving: make(map[string]bool),
+		kinds:     make(map[string]*kind),
+		next:      1,
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			b, ok := e.(bailout)
+			if !ok {
+				panic(e)
+			}
+			err = b.err
+		}
+	}()
+	c.add("engine", "engine", 0)
+
+	// Define every name first, so that statements may refer to
+	// objects defined later, as feedback loops must.
+	for _, s := range ss {
+		if s.x == nil || s.input != "" {
+			continue
+		}
+		if s.name == "engine" || c.defs[s.name] != nil {
+			c.errorf(s.pos, "%v redefined", s.name)
+		}
+		c.defs[s.name] = s
+		c.reserve(s.name)
+		switch x := s.x.(type) {
+		case *number:
+			c.add(s.name, "value", x.v)
+		case *call:
+			if x.output == "" {
+				c.add(s.name, c.kind(x), 0)
+			}
+		case *binary:
+			c.add(s.name, opKind(x.op), 0)
+		case *neg:
+			c.add(s.name, "mul", 0)
+		}
+	}
+	for _, s := range ss {
+		switch {
+		case s.input != "":
+			o := c.objs[s.name]
+			if o == nil {
+				c.errorf(s.pos, "undefined: %v", s.name)
+			}
+			c.connect(s.pos, o, s.input, c.eval(s.x))
+		case s.x != nil:
+			if o := c.objs[s.name]; o != nil {
+				c.fill(o, s.x)
+			} else {
+				c.alias(s)
+			}
+		}
+		if s.display != nil {
+			o := c.objs[s.name]
+			if o == nil {
+				c.errorf(s.pos, "%v is not an object", s.name)
+			}
+			o.Display = s.display
+		}
+	}
+	layout(c.order)
+	return c.order, nil
+}
+
+func (c *compiler) errorf(pos scanner.Position, format string, args ...interface{}) {
+	panic(bailout{&Error{pos, fmt.Sprintf(format, args...)}})
+}
+
+// reserve ensures that generated names don't collide with the given name.
+func (c *compiler) reserve(name string) {
+	i := strings.TrimRight(name, "0123456789")
+	if n, err := strconv.Atoi(name[len(i):]); err == nil && n >= c.next {
+		c.next = n + 1
+	}
+}
+
+func (c *compiler) add(name, kind string, v float64) *ui.Object {
+	o := &ui.Object{Name: name, Kind: kind, Value: v, Input: make(map[string]string)}
+	c.objs[name] = o
+	c.order = append(c.order, o)
+	return o
+}
+
+// anon creates an object with a generated name.
+func (c *compiler) anon(kind string, v float64) *ui.Object {
+	for {
+		name := kind + strconv.Itoa(c.next)
+		c.next++
+		if c.objs[name] == nil && c.defs[name] == nil {
+			return c.add(name, kind, v)
+		}
+	}
+}
+
+// kind returns the kind of object created by a call.
+func (c *compiler) kind(x *call) string {
+	if x.kind == "engine" || x.kind == "value" {
+		c.errorf(x.pos, "can't create %v", x.kind)
+	}
+	if _, ok := audio.LookupKind(x.kind); !ok {
+		c.errorf(x.pos, "unknown kind %v", x.kind)
+	}
+	return x.kind
+}
+
+func opKind(op rune) string {
+	if op == '*' {
+		return "mul"
+	}
+	return "sum"
+}
+
+// eval returns the source of the signal computed by x,
+// creating objects as necessary.
+func (c *compiler) eval(x expr) string {
+	switch x := x.(type) {
+	case *number:
+		return c.anon("value", x.v).Name
+	case *str:
+		c.errorf(x.pos, "string %q is not a signal", x.s)
+	case *ref:
+		return c.ref(x)
+	case *call:
+		o := c.anon(c.kind(x), 0)
+		c.fill(o, x)
+		if x.output != "" {
+			return c.output(x.pos, o, x.kind+"()", x.output)
+		}
+		return o.Name
+	case *binary:
+		o := c.anon(opKind(x.op), 0)
+		c.fill(o, x)
+		return o.Name
+	case *neg:
+		o := c.anon("mul", 0)
+		c.fill(o, x)
+		return o.Name
+	}
+	panic("unreachable")
+}
+
+// fill connects the inputs of o, which was created for x.
+func (c *compiler) fill(o *ui.Object, x expr) {
+	switch x := x.(type) {
+	case *call:
+		// Arguments other than inputs come first,
+		// as the number of steps determines the inputs.
+		k := c.kindOf(o.Kind)
+		var inputs []arg
+		for _, a := range x.args {
+			switch {
+			case a.input == "seed" && k.random:
+				c.seed(o, a)
+			case a.input == "file" && k.file:
+				c.file(o, a)
+			case a.input == "steps" && k.steps:
+				c.steps(o, a)
+			case a.input == "max" && k.delay:
+				c.maxDelay(o, a)
+			default:
+				inputs = append(inputs, a)
+			}
+		}
+		for _, a := range inputs {
+			c.connect(a.pos, o, a.input, c.eval(a.x))
+		}
+	case *binary:
+		c.connect(x.pos, o, "a", c.eval(x.x))
+		y := x.y
+		if x.op == '-' {
+			y = &neg{x.pos, y}
+			if n, ok := x.y.(*number); ok {
+				y = &number{n.pos, -n.v}
+			}
+		}
+		c.connect(x.pos, o, "b", c.eval(y))
+	case *neg:
+		c.connect(x.pos, o, "a", c.eval(x.x))
+		c.connect(x.pos, o, "b", c.eval(&number{x.pos, -1}))
+	}
+}
+
+// seed sets the seed of o, a random object, from argument a.
+func (c *compiler) seed(o *ui.Object, a arg) {
+	n, ok := a.x.(*number)
+	if !ok || n.v != math.Trunc(n.v) || math.Abs(n.v) >= 1<<53 {
+		c.errorf(a.pos, "seed of %v must be a whole number", o.Name)
+	}
+	if o.Seed != 0 {
+		c.errorf(a.pos, "%v seeded twice", o.Name)
+	}
+	o.Seed = int64(n.v)
+}
+
+// steps sets the number of steps of o, a sequencer, from argument a.
+func (c *compiler) steps(o *ui.Object, a arg) {
+	n, ok := a.x.(*number)
+	if !ok || n.v != math.Trunc(n.v) || n.v < 1 || n.v > audio.MaxSteps {
+		c.errorf(a.pos, "steps of %v must be a whole number from 1 to %v", o.Name, audio.MaxSteps)
+	}
+	if o.Steps != 0 {
+		c.errorf(a.pos, "%v given steps twice", o.Name)
+	}
+	o.Steps = int(n.v)
+}
+
+// maxDelay sets the longest delay of o, a delay line, from argument a.
+func (c *compiler) maxDelay(o *ui.Object, a arg) {
+	n, ok := a.x.(*number)
+	if !ok || n.v <= 0 || n.v > audio.LongestDelay {
+		c.errorf(a.pos, "max of %v must be a number of seconds, more than 0 and at most %v", o.Name, audio.LongestDelay)
+	}
+	if o.MaxDelay != 0 {
+		c.errorf(a.pos, "%v given max twice", o.Name)
+	}
+	o.MaxDelay = n.v
+}
+
+// file sets the file played by o, a sampler, from argument a.
+func (c *compiler) file(o *ui.Object, a arg) {
+	s, ok := a.x.(*str)
+	if !ok || s.s == "" {
+		c.errorf(a.pos, "file of %v must be a file name in quotes", o.Name)
+	}
+	if o.File != "" {
+		c.errorf(a.pos, "%v given two files", o.Name)
+	}
+	o.File = s.s
+}
+
+// ref returns the source referred to by x.
+func (c *compiler) ref(x *ref) string {
+	name := x.name
+	if s := c.defs[name]; s != nil && c.objs[name] == nil {
+		name = c.alias(s)
+		if x.output == "" {
+			return name
+		}
+		if strings.Contains(name, ".") {
+			c.errorf(x.pos, "%v is an output of %v", x.name, name)
+		}
+	}
+	o := c.objs[name]
+	if o == nil {
+		c.errorf(x.pos, "undefined: %v", x.name)
+	}
+	if o.Kind == "engine" {
+		c.errorf(x.pos, "the engine has no outputs")
+	}
+	if x.output == "" {
+		return name
+	}
+	return c.output(x.pos, o, x.name, x.output)
+}
+
+// output returns the source for the named output of o,
+// which is described as desc in error messages.
+func (c *compiler) output(pos scanner.Position, o *ui.Object, desc, output string) string {
+	for _, out := range c.kindOf(o.Kind).outputs {
+		if out == output {
+			return o.Name + "." + output
+		}
+	}
+	c.errorf(pos, "%v has no output %v", desc, output)
+	panic("unreachable")
+}
+
+// alias returns the source of the name defined by statement s,
+// which doesn't create an object of that name.
+func (c *compiler) alias(s *stmt) string {
+	if src, ok := c.aliases[s.name]; ok {
+		return src
+	}
+	if c.resolving[s.name] {
+		c.errorf(s.pos, "%v is defined in terms of itself", s.name)
+	}
+	c.resolving[s.name] = true
+	src := c.eval(s.x)
+	c.aliases[s.name] = src
+	return src
+}
+
+// connect connects the source from to the named input of o.
+func (c *compiler) connect(pos scanner.Position, o *ui.Object, input, from string) {
+	if o.Kind != "engine" {
+		inputs := c.kindOf(o.Kind).inputs
+		if o.Steps != 0 {
+			inputs = stepInputs(o.Kind, o.Steps)
+		}
+		i := sort.SearchStrings(inputs, input)
+		if i == len(inputs) || inputs[i] != input {
+			c.errorf(pos, "%v has no input %v", o.Name, input)
+		}
+	}
+	if _, dup := o.Input[input]; dup {
+		c.errorf(pos, "%v.%v connected twice", o.Name, input)
+	}
+	o.Input[input] = from
+}
+
+// A kind holds the sorted inputs and the outputs of a kind of object.
+// Kinds with a single output have no output names.
+// Random kinds take a seed as though it were an input, kinds that
+// play files take a file, kinds with steps take their number, and
+// kinds with a delay take its maximum.
+// The inputs are those of an object with the default number of steps.
+type kind struct {
+	inputs, outputs            []string
+	random, file, steps, delay bool
+}
+
+func (c *compiler) kindOf(name string) *kind {
+	if k := c.kinds[name]; k != nil {
+		return k
+	}
+	k := &kind{}
+	if p, err := audio.NewKind(name); err == nil {
+		if s, ok := p.(audio.Sink); ok {
+			k.inputs = s.Inputs()
+		}
+		if m, ok := p.(audio.MultiProcessor); ok {
+			k.outputs = m.Outputs()
+		}
+		_, k.random = p.(audio.Seeder)
+		_, k.file = p.(audio.Player)
+		_, k.steps = p.(audio.Stepper)
+		_, k.delay = p.(audio.Delayer)
+	}
+	c.kinds[name] = k
+	return k
+}
+
+// stepInputs returns the sorted inputs of an object of the named kind,
+// which implements audio.Stepper, with n steps.
+func stepInputs(kind string, n int) []string {
+	p, err := audio.NewKind(kind)
+	if err != nil {
+		return nil
+	}
+	p.(audio.Stepper).SetSteps(n)
+	return p.(audio.Sink).Inputs()
+}
+
+// Dimensions of the layout given to objects without a display position.
+const (
+	layoutLeft   = 640 // Position of the engine.
+	layoutTop    = 300
+	layoutColumn = 160 // Space between columns.
+	layoutRow    = 60  // Space between objects in a column.
+	layoutMargin = 20
+)
+
+// layout positions the objects that have no display position
+// in columns by their distance from the engine.
+func layout(objs []*ui.Object) {
+	byName := make(map[string]*ui.Object)
+	var todo []*ui.Object
+	for _, o := range objs {
+		byName[o.Name] = o
+		if _, ok := o.Display["offset"]; !ok {
+			todo = append(todo, o)
+		}
+	}
+	if len(todo) == 0 {
+		return
+	}
+	// Breadth-first from the engine, against the connections.
+	depth := map[string]int{"engine": 0}
+	queue := []string{"engine"}
+	for len(queue) > 0 {
+		o := byName[queue[0]]
+		queue = queue[1:]
+		var inputs []string
+		for input := range o.Input {
+			inputs = append(inputs, input)
+		}
+		sort.Strings(inputs)
+		for _, input := range inputs {
+			name, _ := ui.SplitOutput(o.Input[input])
+			if _, ok := depth[name]; !ok && byName[name] != nil {
+				depth[name] = depth[o.Name] + 1
+				queue = append(queue, name)
+			}
+		}
+	}
+	max := 0
+	for _, d := range depth {
+		if d > max {
+			max = d
+		}
+	}
+	// Objects that don't reach the engine go in a column of their own.
+	rows := make(map[int]int)
+	shift := (max+1)*layoutColumn + layoutMargin - layoutLeft
+	if shift < 0 {
+		shift = 0
+	}
+	for _, o := range todo {
+		d, ok := depth[o.Name]
+		if !ok {
+			d = max + 1
+		}
+		if o.Display == nil {
+			o.Display = make(map[string]interface{})
+		}
+		o.Display["offset"] = map[string]interface{}{
+			"left": float64(layoutLeft - d*layoutColumn + shift),
+			"top":  float64(layoutTop + rows[d]*layoutRow),
+		}
+		rows[d]++
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/nf/sigourney/ui"
+)
+
+// Dot returns a description of the graph of a patch with the given objects
+// in the DOT language of Graphviz. Each object is labelled with its name,
+// kind, and value, and each connection with the input it feeds.
+// Signals flow from left to right, into the engine.
+func Dot(objs []*ui.Object) []byte {
+	var names []string
+	byName := make(map[string]*ui.Object)
+	for _, o := range objs {
+		names = append(names, o.Name)
+		byName[o.Name] = o
+	}
+	ui.SortNames(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph patch {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, name := range names {
+		o := byName[name]
+		label := []string{name}
+		var attrs string
+		switch o.Kind {
+		case "engine":
+			attrs = ", style=bold"
+		case "value":
+			label = append(label, formatFloat(o.Value))
+			attrs = ", shape=plaintext"
+		default:
+			if o.Kind != name {
+				label = append(label, o.Kind)
+			}
+		}
+		if l, ok := o.Display["label"].(string); ok && l != "" {
+			label = append(label, `"`+l+`"`)
+		}
+		fmt.Fprintf(&buf, "\t%v [label=%v%v];\n", dotQuote(name), dotLabel(label), attrs)
+	}
+	for _, name := range names {
+		o := byName[name]
+		for _, input := range o.SortedInputs() {
+			from, output := ui.SplitOutput(o.Input[input])
+			fmt.Fprintf(&buf, "\t%v -> %v [label=%v", dotQuote(from), dotQuote(name), dotQuote(input))
+			if output != "" {
+				fmt.Fprintf(&buf, ", taillabel=%v", dotQuote(output))
+			}
+			buf.WriteString("];\n")
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// SVG draws a graph described in the DOT language, as returned by Dot,
+// in SVG format. It requires the dot command of Graphviz.
+func SVG(dot []byte) ([]byte, error) {
+	cmd := exec.Command("dot", "-Tsvg")
+	cmd.Stdin = bytes.NewReader(dot)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("dot: %v: %v", err, msg)
+		}
+		return nil, fmt.Errorf("dot: %v", err)
+	}
+	return b, nil
+}
+
+// dotLabel returns a DOT label with each of the given lines.
+func dotLabel(lines []string) string {
+	for i, l := range lines {
+		lines[i] = dotEscape(l)
+	}
+	return `"` + strings.Join(lines, `\n`) + `"`
+}
+
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package lang implements a text format for Sigourney patches,
+and converts between it and the JSON format saved by the user interface.
+
+A patch is a sequence of statements, separated by newlines or semicolons.
+A statement of the form
+
+	name = expression
+
+defines an object. A call such as sin(pitch: lfo) creates an object of the
+named kind and connects each argument to the input of the same name.
+A number creates a "value" object, the operators +, - and * create "sum"
+and "mul" objects, and a reference to another object gives it a second name.
+Objects created inside an expression are named after their kind, as
+the user interface names them. A statement of the form
+
+	name.input = expression
+
+connects an expression to an input of an object, typically the engine.
+Names may be used before they are defined, which permits feedback loops.
+An output other than the first is selected with a dot, as in seq.gate.
+Comments start with // and extend to the end of the line.
+
+Random objects, such as noise, also take a seed argument, as in
+noise(seed: 42). Without one, an object is seeded by its name.
+Samplers take the name of the WAV file they play, relative to the
+samples directory, as in sampler(trig: clock, file: "kick.wav").
+Sequencers take their number of steps, as in sequencer(steps: 8),
+which otherwise defaults to 4. Delay lines take their longest delay in
+seconds, as in delayline(in: osc, len: 4, max: 5), which otherwise
+defaults to 1.
+
+For example, this patch plays a sine wave whose pitch is modulated by
+another one, with an echo:
+
+	lfo = sin(pitch: -0.5)
+	osc = sin(pitch: lfo * 0.1)
+	echo = delay(in: osc + echo * 0.5, len: 0.25)
+	engine.in = osc + echo
+
+The position and label of an object in the user interface may follow its
+definition, or be given in a statement of their own:
+
+	osc = sin(pitch: lfo * 0.1) @(200, 150, "carrier")
+	engine @(640, 300)
+
+Objects without a position are laid out automatically.
+Other display settings are not represented.
+
+Dot describes the graph of a patch for Graphviz, to draw it as a diagram.
+*/
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/scanner"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/ui"
+)
+
+// Ext is the file name extension of patches in the text format.
+// Patches with other names are in the JSON format.
+const Ext = ".sig"
+
+// Objects compiles the patch in src, and returns its objects
+// in the form used by the JSON format. The filename is used
+// in error messages.
+func Objects(filename string, src []byte) ([]*ui.Object, error) {
+	ss, err := parse(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	return compile(ss)
+}
+
+// A Builder creates a graph of objects. It is implemented by *ui.UI.
+type Builder interface {
+	NewObject(name, kind string, value float64) error
+	Connect(from, to, input string) error
+	SetDisplay(name string, display map[string]interface{}) error
+	SetSeed(name string, seed int64) error
+	SetFile(name, file string) error
+	SetSteps(name string, n int) error
+	SetMaxDelay(name string, seconds float64) error
+}
+
+// Compile compiles the patch in src and creates its objects,
+// connections, seeds, files, steps, maximum delays, and display settings
+// through b.
+// The engine object is assumed to exist already.
+func Compile(filename string, src []byte, b Builder) error {
+	objs, err := Objects(filename, src)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if o.Kind != "engine" {
+			if err := b.NewObject(o.Name, o.Kind, o.Value); err != nil {
+				return err
+			}
+		}
+		if o.Seed != 0 {
+			if err := b.SetSeed(o.Name, o.Seed); err != nil {
+				return err
+			}
+		}
+		if o.File != "" {
+			if err := b.SetFile(o.Name, o.File); err != nil {
+				return err
+			}
+		}
+		if o.Steps != 0 {
+			if err := b.SetSteps(o.Name, o.Steps); err != nil {
+				return err
+			}
+		}
+		if o.MaxDelay != 0 {
+			if err := b.SetMaxDelay(o.Name, o.MaxDelay); err != nil {
+				return err
+			}
+		}
+	}
+	for _, o := range objs {
+		for _, input := range o.SortedInputs() {
+			if err := b.Connect(o.Input[input], o.Name, input); err != nil {
+				return err
+			}
+		}
+	}
+	for _, o := range objs {
+		if o.Display != nil {
+			if err := b.SetDisplay(o.Name, o.Display); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Format returns the text form of a patch with the given objects.
+// Each object is defined on a line of its own, after those it depends on
+// where possible, followed by the connections to the engine.
+func Format(objs []*ui.Object) ([]byte, error) {
+	byName := make(map[string]*ui.Object)
+	var names []string
+	for _, o := range objs {
+		if !isName(o.Name) {
+			return nil, fmt.Errorf("can't format object name %q", o.Name)
+		}
+		byName[o.Name] = o
+		names = append(names, o.Name)
+	}
+	ui.SortNames(names)
+
+	var buf bytes.Buffer
+	done := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		o := byName[name]
+		if o == nil || done[name] || o.Kind == "engine" {
+			return
+		}
+		done[name] = true
+		for _, input := range o.SortedInputs() {
+			from, _ := ui.SplitOutput(o.Input[input])
+			visit(from)
+		}
+		fmt.Fprintf(&buf, "%v = ", name)
+		if o.Kind == "value" {
+			buf.WriteString(formatFloat(o.Value))
+		} else {
+			fmt.Fprintf(&buf, "%v(", o.Kind)
+			var args []string
+			for _, input := range o.SortedInputs() {
+				args = append(args, fmt.Sprintf("%v: %v", input, o.Input[input]))
+			}
+			if o.Seed != 0 && o.Seed != ui.DefaultSeed(name) {
+				args = append(args, fmt.Sprintf("seed: %d", o.Seed))
+			}
+			if o.File != "" {
+				args = append(args, fmt.Sprintf("file: %q", o.File))
+			}
+			if o.Steps != 0 && o.Steps != audio.DefaultSteps {
+				args = append(args, fmt.Sprintf("steps: %d", o.Steps))
+			}
+			if o.MaxDelay != 0 && o.MaxDelay != audio.DefaultMaxDelay {
+				args = append(args, "max: "+formatFloat(o.MaxDelay))
+			}
+			buf.WriteString(strings.Join(args, ", "))
+			buf.WriteString(")")
+		}
+		formatDisplay(&buf, o.Display)
+		buf.WriteString("\n")
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	if e := byName["engine"]; e != nil {
+		for _, input := range e.SortedInputs() {
+			fmt.Fprintf(&buf, "engine.%v = %v\n", input, e.Input[input])
+		}
+		if e.Display["offset"] != nil {
+			buf.WriteString("engine")
+			formatDisplay(&buf, e.Display)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func formatDisplay(buf *bytes.Buffer, d map[string]interface{}) {
+	off, _ := d["offset"].(map[string]interface{})
+	left, ok1 := off["left"].(float64)
+	top, ok2 := off["top"].(float64)
+	if !ok1 || !ok2 {
+		return
+	}
+	fmt.Fprintf(buf, " @(%v, %v", formatFloat(left), formatFloat(top))
+	if label, ok := d["label"].(string); ok {
+		fmt.Fprintf(buf, ", %q", label)
+	}
+	buf.WriteString(")")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// isName reports whether s may be used as a name in the text format.
+func isName(s string) bool {
+	var sc scanner.Scanner
+	sc.Init(bytes.NewReader([]byte(s)))
+	sc.Error = func(*scanner.Scanner, string) {}
+	return sc.Scan() == scanner.Ident && sc.TokenText() == s
+}
+
+// ReadFile reads the patch in the named file, which is in the
+// text format if its name ends in Ext, and the JSON format otherwise.
+func ReadFile(name string) ([]*ui.Object, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(name) == Ext {
+		return Objects(name, b)
+	}
+	m := make(map[string]*ui.Object)
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	var objs []*ui.Object
+	for _, o := range m {
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+
+// WriteFile writes a patch with the given objects to the named file,
+// in the format chosen by its name as for ReadFile.
+func WriteFile(name string, objs []*ui.Object) error {
+	var b []byte
+	var err error
+	if filepath.Ext(name) == Ext {
+		b, err = Format(objs)
+	} else {
+		m := make(map[string]*ui.Object)
+		for _, o := range objs {
+			m[o.Name] = o
+		}
+		b, err = json.MarshalIndent(m, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, b, 0644)
+}
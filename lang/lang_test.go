@@ -0,0 +1,319 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lang
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/ui"
+)
+
+// inputs returns the connections of each object, keyed by object name.
+func inputs(objs []*ui.Object) map[string]map[string]string {
+	m := make(map[string]map[string]string)
+	for _, o := range objs {
+		m[o.Name] = o.Input
+	}
+	return m
+}
+
+func TestObjects(t *testing.T) {
+	const src = `
+lfo = sin(pitch: -0.5)
+osc = sin(pitch: lfo * 0.1)  // A comment.
+echo = delay(
+	in: osc + echo * 0.5,
+	len: 0.25,
+) @(100, 50.5, "echo")
+gate = sequencer(trig: osc).gate; engine.in = osc - gate
+`
+	objs, err := Objects("test", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"engine":     {"in": "sum9"},
+		"lfo":        {"pitch": "value1"},
+		"osc":        {"pitch": "mul2"},
+		"echo":       {"in": "sum4", "len": "value7"},
+		"value1":     {},
+		"mul2":       {"a": "lfo", "b": "value3"},
+		"value3":     {},
+		"sum4":       {"a": "osc", "b": "mul5"},
+		"mul5":       {"a": "echo", "b": "value6"},
+		"value6":     {},
+		"value7":     {},
+		"sum9":       {"a": "osc", "b": "mul10"},
+		"mul10":      {"a": "sequencer8.gate", "b": "value11"},
+		"sequencer8": {"trig": "osc"},
+		"value11":    {},
+	}
+	if got := inputs(objs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got inputs\n%v\nwant\n%v", got, want)
+	}
+	values := map[string]float64{"value1": -0.5, "value3": 0.1, "value6": 0.5, "value7": 0.25, "value11": -1}
+	for _, o := range objs {
+		if v, ok := values[o.Name]; ok && o.Value != v {
+			t.Errorf("%v.Value == %v, want %v", o.Name, o.Value, v)
+		}
+		if o.Display["offset"] == nil {
+			t.Errorf("%v has no position", o.Name)
+		}
+		if o.Name == "echo" && o.Display["label"] != "echo" {
+			t.Errorf("echo has display %v", o.Display)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, c := range []struct{ src, err string }{
+		{"x = sin(", "test:1:9: expected name, found end of file"},
+		{"x = 1 2", `test:1:7: expected end of statement, found "2"`},
+		{"x = bogus()", "test:1:5: unknown kind bogus"},
+		{"x = sin(freq: 1)", "test:1:9: x has no input freq"},
+		{"x = sin()\nx = sin()", "test:2:1: x redefined"},
+		{"engine.in = y", "test:1:13: undefined: y"},
+		{"engine.in = sin().gate", "test:1:13: sin() has no output gate"},
+		{"s = sin(); engine.in = s.gate", "test:1:24: s has no output gate"},
+		{"a = b; b = a", "test:1:1: a is defined in terms of itself"},
+		{"x = sin(pitch: 1, pitch: 2)", "test:1:19: x.pitch connected twice"},
+		{"x = engine", "test:1:5: the engine has no outputs"},
+		{"x = noise(seed: 0.5)", "test:1:11: seed of x must be a whole number"},
+		{"x = sin(seed: 1)", "test:1:9: x has no input seed"},
+		{"x = sampler(file: 1)", "test:1:13: file of x must be a file name in quotes"},
+		{`x = sampler(file: "a.wav", file: "b.wav")`, "test:1:28: x given two files"},
+		{`x = sampler(pitch: "a.wav")`, `test:1:20: string "a.wav" is not a signal`},
+		{"x = sequencer(v4: 1)", "test:1:15: x has no input v4"},
+		{"x = sequencer(steps: 65)", "test:1:15: steps of x must be a whole number from 1 to 64"},
+		{"x = sequencer(steps: 2, v3: 1)", "test:1:25: x has no input v3"},
+		{"x = delayline(max: 0)", "test:1:15: max of x must be a number of seconds, more than 0 and at most 60"},
+		{"x = delayline(max: 2, max: 3)", "test:1:23: x given max twice"},
+		{"x = delay(max: 2)", "test:1:11: x has no input max"},
+	} {
+		_, err := Objects("test", []byte(c.src))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: got error %v, want %v", c.src, err, c.err)
+		}
+	}
+}
+
+// normalize returns the JSON encoding of objs, keyed by name.
+// Default seeds, steps and maximum delays are left out,
+// as Format leaves them out.
+func normalize(t *testing.T, objs []*ui.Object) string {
+	m := make(map[string]*ui.Object)
+	for _, o := range objs {
+		if o.Seed == ui.DefaultSeed(o.Name) || o.Steps == audio.DefaultSteps || o.MaxDelay == audio.DefaultMaxDelay {
+			c := *o
+			if c.Seed == ui.DefaultSeed(o.Name) {
+				c.Seed = 0
+			}
+			if c.Steps == audio.DefaultSteps {
+				c.Steps = 0
+			}
+			if c.MaxDelay == audio.DefaultMaxDelay {
+				c.MaxDelay = 0
+			}
+			o = &c
+		}
+		m[o.Name] = o
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../patch/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		objs, err := ReadFile(f)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		src, err := Format(objs)
+		if err != nil {
+			t.Errorf("%v: %v", f, err)
+			continue
+		}
+		objs2, err := Objects(f, src)
+		if err != nil {
+			t.Errorf("%v: %v\n%s", f, err, src)
+			continue
+		}
+		if a, b := normalize(t, objs), normalize(t, objs2); a != b {
+			t.Errorf("%v: round trip changed patch\n%s\ngot  %v\nwant %v", f, src, b, a)
+		}
+	}
+}
+
+// recorder is a Builder that records the calls made to it.
+type recorder struct{ calls []string }
+
+func (r *recorder) NewObject(name, kind string, value float64) error {
+	r.calls = append(r.calls, "new "+name+" "+kind)
+	return nil
+}
+
+func (r *recorder) Connect(from, to, input string) error {
+	r.calls = append(r.calls, "connect "+from+" "+to+"."+input)
+	return nil
+}
+
+func (r *recorder) SetDisplay(name string, display map[string]interface{}) error {
+	r.calls = append(r.calls, "display "+name)
+	return nil
+}
+
+func (r *recorder) SetSeed(name string, seed int64) error {
+	r.calls = append(r.calls, fmt.Sprintf("seed %v %v", name, seed))
+	return nil
+}
+
+func (r *recorder) SetFile(name, file string) error {
+	r.calls = append(r.calls, fmt.Sprintf("file %v %v", name, file))
+	return nil
+}
+
+func (r *recorder) SetSteps(name string, n int) error {
+	r.calls = append(r.calls, fmt.Sprintf("steps %v %v", name, n))
+	return nil
+}
+
+func (r *recorder) SetMaxDelay(name string, seconds float64) error {
+	r.calls = append(r.calls, fmt.Sprintf("max %v %v", name, seconds))
+	return nil
+}
+
+func TestCompile(t *testing.T) {
+	var r recorder
+	const src = `osc = sin(pitch: noise(seed: 7))
+kick = sampler(trig: osc, file: "drums/kick.wav")
+engine.in = osc + kick`
+	if err := Compile("test", []byte(src), &r); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"new osc sin", "new kick sampler", "file kick drums/kick.wav",
+		"new noise1 noise", "seed noise1 7", "new sum2 sum",
+		"connect sum2 engine.in", "connect noise1 osc.pitch", "connect osc kick.trig",
+		"connect osc sum2.a", "connect kick sum2.b",
+		"display engine", "display osc", "display kick", "display noise1", "display sum2",
+	}
+	if got := strings.Join(r.calls, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("got calls\n%v\nwant\n%v", got, strings.Join(want, "\n"))
+	}
+
+	// A UI accepts the compiled patch.
+	var _ Builder = (*ui.UI)(nil)
+
+	// Format keeps the file.
+	objs, err := Objects("test", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Format(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `kick = sampler(trig: osc, file: "drums/kick.wav")`; !bytes.Contains(b, []byte(want)) {
+		t.Errorf("Format gave\n%s\nwant a line %v", b, want)
+	}
+
+	// The number of steps is set before the inputs are connected.
+	r.calls = nil
+	if err := Compile("test", []byte("seq = sequencer(v5: 0.5, steps: 6)"), &r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(r.calls[:3], "\n"), "new seq sequencer\nsteps seq 6\nnew value1 value"; got != want {
+		t.Errorf("got calls\n%v\nwant\n%v", got, want)
+	}
+	if objs, err = Objects("test", []byte("seq = sequencer(v5: 0.5, steps: 6)")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = Format(objs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "seq = sequencer(v5: value1, steps: 6)"; !bytes.Contains(b, []byte(want)) {
+		t.Errorf("Format gave\n%s\nwant a line %v", b, want)
+	}
+
+	// So is the maximum delay.
+	r.calls = nil
+	if err := Compile("test", []byte("echo = delayline(len: 4, max: 5)"), &r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(r.calls[:2], "\n"), "new echo delayline\nmax echo 5"; got != want {
+		t.Errorf("got calls\n%v\nwant\n%v", got, want)
+	}
+	if objs, err = Objects("test", []byte("echo = delayline(len: 4, max: 5)")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = Format(objs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo = delayline(len: value1, max: 5)"; !bytes.Contains(b, []byte(want)) {
+		t.Errorf("Format gave\n%s\nwant a line %v", b, want)
+	}
+}
+
+func TestDot(t *testing.T) {
+	objs, err := Objects("test", []byte(`
+seq = sequencer(trig: sin(pitch: -0.5)) @(10, 20, "the \"tune\"")
+engine.in = seq.gate * sin(pitch: seq)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := Dot(objs)
+	for _, want := range []string{
+		"digraph patch {\n",
+		`"engine" [label="engine", style=bold];`,
+		`"seq" [label="seq\nsequencer\n\"the \"tune\"\""];`,
+		`"value2" [label="value2\n-0.5", shape=plaintext];`,
+		`"seq" -> "mul3" [label="a", taillabel="gate"];`,
+		`"mul3" -> "engine" [label="in"];`,
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("DOT lacks %s:\n%s", want, b)
+		}
+	}
+
+	if _, err := exec.LookPath("dot"); err != nil {
+		t.Skip("dot command not found")
+	}
+	svg, err := SVG(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(svg, []byte("<svg")) {
+		t.Errorf("SVG output lacks <svg:\n%s", svg)
+	}
+}
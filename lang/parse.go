@@ -0,0 +1,379 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lang
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"text/scanner"
+)
+
+// A stmt is a statement of one of the forms
+//
+//	name = x @(left, top, "label")
+//	name.input = x
+//	name @(left, top, "label")
+//
+// where the display annotation is optional in the first form.
+type stmt struct {
+	pos     scanner.Position
+	name    string
+	input   string // Empty unless connecting to an input.
+	x       expr   // Nil for a display statement.
+	display map[string]interface{}
+}
+
+// An expr is an expression that evaluates to a signal.
+type expr interface {
+	position() scanner.Position
+}
+
+type (
+	// number is a constant, such as 0.5.
+	number struct {
+		pos scanner.Position
+		v   float64
+	}
+	// str is a quoted string, such as the file name in
+	// sampler(file: "kick.wav"). It is not a signal.
+	str struct {
+		pos scanner.Position
+		s   string
+	}
+	// ref refers to a named object, or to one of its outputs.
+	ref struct {
+		pos          scanner.Position
+		name, output string
+	}
+	// call creates an object of the given kind, such as sin(pitch: x),
+	// and may select one of its outputs, as in sequencer(trig: x).gate.
+	call struct {
+		pos    scanner.Position
+		kind   string
+		args   []arg
+		output string
+	}
+	// binary is the sum, difference, or product of two expressions.
+	binary struct {
+		pos  scanner.Position
+		op   rune // '+', '-', or '*'.
+		x, y expr
+	}
+	// neg is the negation of an expression.
+	neg struct {
+		pos scanner.Position
+		x   expr
+	}
+)
+
+type arg struct {
+	pos   scanner.Position
+	input string
+	x     expr
+}
+
+func (x *number) position() scanner.Position { return x.pos }
+func (x *str) position() scanner.Position    { return x.pos }
+func (x *ref) position() scanner.Position    { return x.pos }
+func (x *call) position() scanner.Position   { return x.pos }
+func (x *binary) position() scanner.Position { return x.pos }
+func (x *neg) position() scanner.Position    { return x.pos }
+
+// An Error describes a problem with a patch,
+// and where in its source the problem lies.
+type Error struct {
+	Pos scanner.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Pos, e.Msg)
+}
+
+type parser struct {
+	s     scanner.Scanner
+	tok   rune
+	pos   scanner.Position
+	depth int // Parenthesis depth; newlines inside parentheses are ignored.
+}
+
+// bailout is panicked by the parser to report an error.
+type bailout struct{ err *Error }
+
+// parse parses the statements of a patch.
+func parse(filename string, src []byte) (ss []*stmt, err error) {
+	p := &parser{}
+	p.s.Init(bytes.NewReader(src))
+	p.s.Filename = filename
+	p.s.Mode = scanner.ScanIdents | scanner.ScanFloats | scanner.ScanStrings |
+		scanner.ScanComments | scanner.SkipComments
+	p.s.Whitespace = 1<<'\t' | 1<<'\r' | 1<<' '
+	p.s.Error = func(s *scanner.Scanner, msg string) {
+		p.errorf(s.Pos(), "%s", msg)
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			b, ok := e.(bailout)
+			if !ok {
+				panic(e)
+			}
+			err = b.err
+		}
+	}()
+	p.next()
+	return p.file(), nil
+}
+
+func (p *parser) errorf(pos scanner.Position, format string, args ...interface{}) {
+	panic(bailout{&Error{pos, fmt.Sprintf(format, args...)}})
+}
+
+func (p *parser) next() {
+	for {
+		p.tok = p.s.Scan()
+		p.pos = p.s.Position
+		if p.tok != '\n' || p.depth == 0 {
+			return
+		}
+	}
+}
+
+// describe returns a description of the current token, for error messages.
+func (p *parser) describe() string {
+	switch p.tok {
+	case scanner.EOF:
+		return "end of file"
+	case '\n':
+		return "newline"
+	}
+	return strconv.Quote(p.s.TokenText())
+}
+
+func (p *parser) expect(tok rune) {
+	if p.tok != tok {
+		p.errorf(p.pos, "expected %v, found %v", scanner.TokenString(tok), p.describe())
+	}
+	if tok == ')' {
+		p.depth--
+	}
+	p.next()
+}
+
+// open consumes an opening parenthesis.
+func (p *parser) open() {
+	if p.tok != '(' {
+		p.expect('(')
+	}
+	p.depth++
+	p.next()
+}
+
+func (p *parser) ident() string {
+	if p.tok != scanner.Ident {
+		p.errorf(p.pos, "expected name, found %v", p.describe())
+	}
+	name := p.s.TokenText()
+	p.next()
+	return name
+}
+
+func (p *parser) file() []*stmt {
+	var ss []*stmt
+	for {
+		for p.tok == '\n' || p.tok == ';' {
+			p.next()
+		}
+		if p.tok == scanner.EOF {
+			return ss
+		}
+		ss = append(ss, p.stmt())
+		switch p.tok {
+		case '\n', ';', scanner.EOF:
+		default:
+			p.errorf(p.pos, "expected end of statement, found %v", p.describe())
+		}
+	}
+}
+
+func (p *parser) stmt() *stmt {
+	s := &stmt{pos: p.pos}
+	s.name = p.ident()
+	if p.tok == '.' {
+		p.next()
+		s.input = p.ident()
+	}
+	if p.tok == '@' && s.input == "" {
+		s.display = p.display()
+		return s
+	}
+	p.expect('=')
+	s.x = p.expr()
+	if p.tok == '@' && s.input == "" {
+		s.display = p.display()
+	}
+	return s
+}
+
+// display parses a display annotation of the form @(left, top, "label"),
+// in which the label is optional.
+func (p *parser) display() map[string]interface{} {
+	p.expect('@')
+	p.open()
+	left := p.signed()
+	p.expect(',')
+	top := p.signed()
+	d := map[string]interface{}{
+		"offset": map[string]interface{}{"left": left, "top": top},
+	}
+	if p.tok == ',' {
+		p.next()
+		if p.tok != scanner.String {
+			p.errorf(p.pos, "expected label, found %v", p.describe())
+		}
+		label, err := strconv.Unquote(p.s.TokenText())
+		if err != nil {
+			p.errorf(p.pos, "bad label: %v", err)
+		}
+		d["label"] = label
+		p.next()
+	}
+	p.expect(')')
+	return d
+}
+
+// signed parses a number with an optional leading minus sign.
+func (p *parser) signed() float64 {
+	sign := 1.0
+	if p.tok == '-' {
+		sign = -1
+		p.next()
+	}
+	if p.tok != scanner.Float && p.tok != scanner.Int {
+		p.errorf(p.pos, "expected number, found %v", p.describe())
+	}
+	return sign * p.number()
+}
+
+func (p *parser) number() float64 {
+	v, err := strconv.ParseFloat(p.s.TokenText(), 64)
+	if err != nil {
+		p.errorf(p.pos, "bad number: %v", err)
+	}
+	p.next()
+	return v
+}
+
+// expr parses a sum or difference of terms.
+func (p *parser) expr() expr {
+	x := p.term()
+	for p.tok == '+' || p.tok == '-' {
+		op, pos := p.tok, p.pos
+		p.next()
+		x = fold(&binary{pos, op, x, p.term()})
+	}
+	return x
+}
+
+// term parses a product of factors.
+func (p *parser) term() expr {
+	x := p.factor()
+	for p.tok == '*' {
+		pos := p.pos
+		p.next()
+		x = fold(&binary{pos, '*', x, p.factor()})
+	}
+	return x
+}
+
+func (p *parser) factor() expr {
+	pos := p.pos
+	switch p.tok {
+	case scanner.Float, scanner.Int:
+		return &number{pos, p.number()}
+	case scanner.String:
+		s, err := strconv.Unquote(p.s.TokenText())
+		if err != nil {
+			p.errorf(pos, "bad string: %v", err)
+		}
+		p.next()
+		return &str{pos, s}
+	case '-':
+		p.next()
+		x := p.factor()
+		if n, ok := x.(*number); ok {
+			return &number{pos, -n.v}
+		}
+		return &neg{pos, x}
+	case '(':
+		p.open()
+		x := p.expr()
+		p.expect(')')
+		return x
+	case scanner.Ident:
+		name := p.ident()
+		switch p.tok {
+		case '(':
+			return p.call(pos, name)
+		case '.':
+			p.next()
+			return &ref{pos, name, p.ident()}
+		}
+		return &ref{pos, name, ""}
+	}
+	p.errorf(pos, "expected expression, found %v", p.describe())
+	panic("unreachable")
+}
+
+// call parses the arguments of a call, such as (pitch: x, syn: y).
+func (p *parser) call(pos scanner.Position, kind string) expr {
+	c := &call{pos: pos, kind: kind}
+	p.open()
+	for p.tok != ')' {
+		a := arg{pos: p.pos}
+		a.input = p.ident()
+		p.expect(':')
+		a.x = p.expr()
+		c.args = append(c.args, a)
+		if p.tok != ',' {
+			break
+		}
+		p.next()
+	}
+	p.expect(')')
+	if p.tok == '.' {
+		p.next()
+		c.output = p.ident()
+	}
+	return c
+}
+
+// fold evaluates operations on constants.
+func fold(b *binary) expr {
+	x, ok1 := b.x.(*number)
+	y, ok2 := b.y.(*number)
+	if !ok1 || !ok2 {
+		return b
+	}
+	switch b.op {
+	case '+':
+		return &number{x.pos, x.v + y.v}
+	case '-':
+		return &number{x.pos, x.v - y.v}
+	}
+	return &number{x.pos, x.v * y.v}
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -29,33 +30,103 @@ import (
 	"github.com/gordonklaus/portaudio"
 	"github.com/rakyll/portmidi"
 
+	"github.com/nf/sigourney/audio"
 	"github.com/nf/sigourney/socket"
+	"github.com/nf/sigourney/wav"
 )
 
 var (
-	listenAddr = flag.String("listen", "localhost:8080", "listen address")
-	doDemo     = flag.Bool("demo", false, "play demo sound")
-	doBrowser  = flag.Bool("browser", true, "open web browser")
+	listenAddr    = flag.String("listen", "localhost:8080", "listen address")
+	doDemo        = flag.Bool("demo", false, "play demo sound")
+	doBrowser     = flag.Bool("browser", true, "open web browser")
+	backendName   = flag.String("backend", "portaudio", "audio backend: portaudio, null, file, or stdout")
+	backendFile   = flag.String("backend_file", "sigourney.wav", "output WAV file for the file backend")
+	backendFormat = flag.String("backend_format", "16", "sample format for the file and stdout backends: 16, 24, or 32f")
+	channels      = flag.Int("channels", 1, "number of output channels")
+	sampleRate    = flag.Int("rate", 44100, "sample rate, in samples per second")
+	blockSize     = flag.Int("block", audio.FrameLength, "samples per channel in each audio block")
+	workers       = flag.Int("workers", 1, "number of goroutines that process the patch")
+	recordDir     = flag.String("record_dir", ".", "directory for recordings made from the browser")
+	recordFormat  = flag.String("record_format", "16", "sample format for recordings: 16, 24, or 32f")
+	sampleDir     = flag.String("sample_dir", audio.SampleDir, "directory of the WAV files played by samplers")
 )
 
 func main() {
 	flag.Parse()
-
-	portaudio.Initialize()
-	defer portaudio.Terminate()
+	audio.SampleDir = *sampleDir
 
 	portmidi.Initialize()
 	defer portmidi.Terminate()
 
+	switch flag.Arg(0) {
+	case "render":
+		if err := render(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "convert":
+		if err := convert(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "gen":
+		if err := genCode(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "dot":
+		if err := dot(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	newBackend, err := backend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *channels < 1 {
+		log.Fatal("-channels must be at least 1")
+	}
+	if *sampleRate < 1 || *blockSize < 1 || *workers < 1 {
+		log.Fatal("-rate, -block, and -workers must be positive")
+	}
+	opts := []audio.Option{
+		audio.Channels(*channels),
+		audio.SampleRate(*sampleRate),
+		audio.BlockSize(*blockSize),
+		audio.Workers(*workers),
+	}
+	if *backendName == "portaudio" {
+		portaudio.Initialize()
+		defer portaudio.Terminate()
+	}
+
+	// Keep messages out of the audio stream when it is written to stdout.
+	msg := io.Writer(os.Stdout)
+	if *backendName == "stdout" {
+		msg = os.Stderr
+	}
+
 	if *doDemo {
-		if err := demo(); err != nil {
+		if err := demo(newBackend, opts, msg); err != nil {
 			log.Println(err)
 		}
 		return
 	}
 
+	rf, err := wav.ParseFormat(*recordFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	socket.NewBackend = newBackend
+	socket.EngineOptions = opts
+	socket.RecordDir = *recordDir
+	socket.RecordFormat = rf
+
 	http.Handle("/", http.FileServer(http.Dir("static")))
 	http.HandleFunc("/socket", socket.Handler)
+	http.HandleFunc("/graph", socket.GraphHandler)
 
 	l, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
@@ -65,13 +136,37 @@ func main() {
 
 	u := fmt.Sprintf("http://%v/", *listenAddr)
 	if !*doBrowser || !openBrowser(u) {
-		fmt.Printf("Open your web browser to %v\n\n", u)
+		fmt.Fprintf(msg, "Open your web browser to %v\n\n", u)
 	}
 
-	fmt.Println("Press enter to quit...")
+	fmt.Fprintln(msg, "Press enter to quit...")
 	os.Stdin.Read([]byte{0})
 }
 
+// backend returns a function that creates
+// the audio backend selected by the -backend flag.
+func backend() (func() audio.Backend, error) {
+	f, err := wav.ParseFormat(*backendFormat)
+	if err != nil {
+		return nil, err
+	}
+	switch *backendName {
+	case "portaudio":
+		return audio.NewPortAudioBackend, nil
+	case "null":
+		return audio.NewNullBackend, nil
+	case "file":
+		return func() audio.Backend {
+			return audio.NewFileBackend(*backendFile, f)
+		}, nil
+	case "stdout":
+		return func() audio.Backend {
+			return audio.NewRawBackend(os.Stdout, f)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", *backendName)
+}
+
 // openBrowser tries to open the URL in a browser,
 // and returns whether it succeed in doing so.
 func openBrowser(url string) bool {
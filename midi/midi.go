@@ -57,3 +57,11 @@ func (m *Gate) Process(s []audio.Sample) {
 		s[i] = p
 	}
 }
+
+func init() {
+	const path = "github.com/nf/sigourney/midi"
+	audio.Register("gate", func() audio.Processor { return NewGate() },
+		audio.KindInfo{Doc: "MIDI note gate", Go: "midi.NewGate()", Import: path})
+	audio.Register("note", func() audio.Processor { return NewNote() },
+		audio.KindInfo{Doc: "MIDI note pitch", Go: "midi.NewNote()", Import: path})
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/lang"
+	"github.com/nf/sigourney/ui"
+	"github.com/nf/sigourney/wav"
+)
+
+// render implements the "render" command, which plays a saved patch
+// into a WAV file without opening an audio device.
+func render(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	var (
+		patch   = fs.String("patch", "", "patch file to render")
+		seconds = fs.Float64("seconds", 10, "duration to render, in seconds")
+		out     = fs.String("o", "out.wav", "output WAV file")
+		format  = fs.String("format", "16", "sample format: 16, 24, or 32f")
+		chans   = fs.Int("channels", 1, "number of output channels")
+		hz      = fs.Int("rate", 44100, "sample rate, in samples per second")
+		workers = fs.Int("workers", 1, "number of goroutines that process the patch")
+	)
+	fs.Parse(args)
+	if *patch == "" {
+		return errors.New("render: -patch must be specified")
+	}
+	if *chans < 1 {
+		return errors.New("render: -channels must be at least 1")
+	}
+	if *hz < 1 {
+		return errors.New("render: -rate must be positive")
+	}
+	if *workers < 1 {
+		return errors.New("render: -workers must be positive")
+	}
+	f, err := wav.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	u := ui.New(nopHandler{}, audio.Channels(*chans), audio.SampleRate(*hz),
+		audio.Workers(*workers))
+	objs, err := lang.ReadFile(*patch)
+	if err != nil {
+		return err
+	}
+	if err := u.LoadObjects(objs, 0); err != nil {
+		return err
+	}
+
+	w, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	rate, nc, fl := u.SampleRate(), u.Channels(), u.FrameLength()
+	enc, err := wav.NewEncoder(w, f, rate, nc)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	// Render one second at a time to keep memory use bounded.
+	perSecond := (rate + fl - 1) / fl
+	n := int(*seconds*float64(rate)) * nc
+	buf := make([]float64, 0, perSecond*fl*nc)
+	for n > 0 {
+		s := u.Render(perSecond)
+		if len(s) > n {
+			s = s[:n]
+		}
+		buf = buf[:0]
+		for _, v := range s {
+			buf = append(buf, float64(v))
+		}
+		if err := enc.Write(buf); err != nil {
+			w.Close()
+			return fmt.Errorf("render: %v", err)
+		}
+		n -= len(s)
+	}
+	if err := enc.Close(); err != nil {
+		w.Close()
+		return fmt.Errorf("render: %v", err)
+	}
+	return w.Close()
+}
+
+// nopHandler is a ui.Handler that discards all messages.
+type nopHandler struct{}
+
+func (nopHandler) Hello(map[string]*ui.Kind) {}
+func (nopHandler) SetGraph([]*ui.Object)     {}
@@ -17,37 +17,77 @@ limitations under the License.
 package socket
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"path/filepath"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/lang"
 	"github.com/nf/sigourney/ui"
+	"github.com/nf/sigourney/wav"
 )
 
 const filePrefix = "patch/"
 
 var validName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
 
+// NewBackend is called to create the audio.Backend for each new Session.
+var NewBackend = audio.NewPortAudioBackend
+
+// EngineOptions configures the audio.Engine of each new Session.
+var EngineOptions []audio.Option
+
+// RecordDir is the directory to which recordings are written,
+// and RecordFormat is their sample format.
+var (
+	RecordDir    = "."
+	RecordFormat = wav.PCM16
+)
+
 type Message struct {
 	Action string
 
 	// Incoming messages
 
-	// "new", "set", "destroy", "save", "load", "setDisplay"
+	// "undo", "redo", "beginGroup", "endGroup",
+	// "startRecording", and "stopRecording" have no arguments.
+
+	// "new", "set", "destroy", "save", "load", "setDisplay", "seed", "reseed", "file", "steps", "maxDelay"
+	// "recording": the file being recorded, or empty if stopped
 	Name string `json:",omitempty"`
 
 	// "new"
 	Kind string `json:",omitempty"`
 
-	// "new", "set"
-	Value float64 `json:",omitempty"` // for Kind: "value"
+	// "new", "set": for Kind: "value"
+	// "load": the time, in seconds, to crossfade to the new patch
+	Value float64 `json:",omitempty"`
+
+	// "seed": the seed of a random object; "reseed" chooses one at random
+	Seed int64 `json:",omitempty"`
+
+	// "file": the WAV file, relative to the samples directory, that a
+	// sampler plays; empty for none
+	File string `json:",omitempty"`
+
+	// "steps": the number of steps of a sequencer
+	Steps int `json:",omitempty"`
+
+	// "maxDelay": the longest delay, in seconds, of a delay line
+	MaxDelay float64 `json:",omitempty"`
 
 	// "connect", "disconnect"
+	// From may name an output of the object as "object.output".
 	From  string `json:",omitEmpty"`
 	To    string `json:",omitempty"`
 	Input string `json:",omitempty"`
@@ -58,7 +98,7 @@ type Message struct {
 	// Outgoing messages
 
 	// "hello"
-	KindInputs map[string][]string `json:",omitempty"`
+	Kinds map[string]*ui.Kind `json:",omitempty"`
 
 	// "setGraph"
 	Graph []*ui.Object `json:",omitempty"`
@@ -67,23 +107,54 @@ type Message struct {
 	Message string
 }
 
+// clientBuffer is the number of outgoing messages buffered for each client.
+// A client that falls further behind than this is disconnected.
+const clientBuffer = 64
+
+// All websocket clients share a single Session,
+// which is closed when the last client leaves.
+var (
+	sharedMu sync.Mutex
+	shared   *Session
+)
+
 func Handler(w http.ResponseWriter, r *http.Request) {
 	c, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer c.Close()
 
-	s, err := NewSession()
+	sharedMu.Lock()
+	if shared == nil {
+		shared, err = NewSession()
+	}
+	s := shared
+	var cl *client
+	if err == nil {
+		cl = s.join()
+	}
+	sharedMu.Unlock()
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer s.Close()
+	defer func() {
+		sharedMu.Lock()
+		if s.leave(cl) == 0 {
+			if err := s.Close(); err != nil {
+				log.Println(err)
+			}
+			shared = nil
+		}
+		sharedMu.Unlock()
+	}()
 
 	go func() {
-		for m := range s.M {
-			if err := c.WriteJSON(m); err != nil {
+		defer c.Close() // Stop the reader, too.
+		for b := range cl.out {
+			if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
 				if err != io.EOF {
 					log.Println(err)
 				}
@@ -100,16 +171,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		if err := s.Handle(m); err != nil {
+		if err := s.handle(cl, m); err != nil {
 			log.Println(err)
 		}
 	}
 }
 
 func NewSession() (*Session, error) {
-	m := make(chan *Message, 1)
-	s := &Session{M: m, m: m}
-	u := ui.New(s)
+	s := &Session{
+		clients: make(map[*client]bool),
+		changed: make(map[*client]bool),
+	}
+	u := ui.New(s, EngineOptions...)
+	u.SetBackend(NewBackend())
 	if err := u.Start(); err != nil {
 		return nil, err
 	}
@@ -117,37 +191,218 @@ func NewSession() (*Session, error) {
 	return s, nil
 }
 
+// A Session is a patch that is edited by one or more clients.
+// Each change made by a client is sent to the others.
 type Session struct {
-	M <-chan *Message
+	mu      sync.Mutex
+	u       *ui.UI
+	kinds   map[string]*ui.Kind
+	clients map[*client]bool
+	changed map[*client]bool // Clients whose changes haven't been sent.
+	group   ui.Group         // The groups begun through Handle.
+	rec     *audio.Recorder
+	recName string
+}
 
-	m chan *Message
-	u *ui.UI
+// A client is a connection that has joined a Session.
+type client struct {
+	out   chan []byte // Encoded Messages; closed when the client leaves.
+	group ui.Group    // The groups begun by the client.
 }
 
 func (s *Session) Close() error {
-	return s.u.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.stopRecording()
+	if err2 := s.u.Stop(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// join adds a client to the Session and sends it the Session's state.
+func (s *Session) join() *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &client{out: make(chan []byte, clientBuffer)}
+	s.clients[c] = true
+	s.send(c, &Message{Action: "hello", Kinds: s.kinds})
+	s.send(c, &Message{Action: "setGraph", Graph: s.u.Objects()})
+	if s.rec != nil {
+		s.send(c, &Message{Action: "recording", Name: s.recName})
+	}
+	return c
+}
+
+// leave removes a client from the Session,
+// and returns the number of clients that remain.
+func (s *Session) leave(c *client) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.u.SwapGroup(&c.group)
+	for s.u.InGroup() {
+		s.u.EndGroup()
+	}
+	s.u.SwapGroup(&c.group)
+	s.drop(c)
+	s.flush(nil)
+	return len(s.clients)
+}
+
+// send sends a message to a client,
+// dropping the client if it isn't keeping up.
+func (s *Session) send(c *client, m *Message) {
+	if !s.clients[c] {
+		return
+	}
+	// Encode the message now, while the objects it refers to
+	// can't be changed by another client.
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	select {
+	case c.out <- b:
+	default:
+		log.Println("socket: dropping slow client")
+		s.drop(c)
+	}
+}
+
+func (s *Session) drop(c *client) {
+	if s.clients[c] {
+		delete(s.clients, c)
+		delete(s.changed, c)
+		close(c.out)
+	}
+}
+
+// broadcast sends a message to every client except the given one.
+func (s *Session) broadcast(m *Message, except *client) {
+	for c := range s.clients {
+		if c != except {
+			s.send(c, m)
+		}
+	}
 }
 
-func (s *Session) Hello(kindInputs map[string][]string) {
-	s.m <- &Message{Action: "hello", KindInputs: kindInputs}
+// flush sends the current graph to the clients that don't
+// already have it, unless c is in the middle of a group of changes.
+// It must be called while c's groups are the UI's current ones.
+func (s *Session) flush(c *client) {
+	if len(s.changed) == 0 || s.u.InGroup() {
+		return
+	}
+	if len(s.changed) > 1 || !s.changed[c] {
+		c = nil // Changes by others must be sent to c, too.
+	}
+	for k := range s.changed {
+		delete(s.changed, k)
+	}
+	s.broadcast(&Message{Action: "setGraph", Graph: s.u.Objects()}, c)
+}
+
+func (s *Session) Hello(kinds map[string]*ui.Kind) {
+	s.kinds = kinds
 }
 
 func (s *Session) SetGraph(graph []*ui.Object) {
-	s.m <- &Message{Action: "setGraph", Graph: graph}
+	s.broadcast(&Message{Action: "setGraph", Graph: graph}, nil)
+}
+
+// GraphHandler serves the graph of a patch in the DOT language of Graphviz,
+// or as SVG if the "format" parameter is "svg". The patch is the saved file
+// named by the "patch" parameter or, if that is empty, the shared session.
+func GraphHandler(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	if name := r.FormValue("patch"); name != "" {
+		if !validName.MatchString(name) {
+			http.Error(w, fmt.Sprintf("name %q doesn't match %v", name, validName), http.StatusBadRequest)
+			return
+		}
+		objs, err := lang.ReadFile(filepath.Join(filePrefix, name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		b = lang.Dot(objs)
+	} else {
+		sharedMu.Lock()
+		if s := shared; s != nil {
+			s.mu.Lock()
+			b = lang.Dot(s.u.Objects())
+			s.mu.Unlock()
+		}
+		sharedMu.Unlock()
+		if b == nil {
+			http.Error(w, "no session", http.StatusNotFound)
+			return
+		}
+	}
+	switch f := r.FormValue("format"); f {
+	case "", "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	case "svg":
+		var err error
+		if b, err = lang.SVG(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", f), http.StatusBadRequest)
+		return
+	}
+	w.Write(b)
+}
+
+// Handle applies a message to the Session, as if it came from a client
+// that hasn't joined. The changes it makes are sent to every client.
+func (s *Session) Handle(m *Message) error {
+	return s.handle(nil, m)
 }
 
-func (s *Session) Handle(m *Message) (err error) {
+// handle applies a message from a client to the Session.
+// A nil client stands for a caller of Handle.
+func (s *Session) handle(c *client, m *Message) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := &s.group
+	if c != nil {
+		g = &c.group
+	}
+	s.u.SwapGroup(g)
+	defer s.u.SwapGroup(g)
 	defer func() {
 		if err != nil {
-			s.m <- &Message{
+			s.send(c, &Message{
 				Action:  "message",
 				Message: err.Error(),
-			}
+			})
+			// c may have shown the change before sending it
+			// (a new object whose name another client took,
+			// say), so send it the graph as it really is.
+			s.send(c, &Message{Action: "setGraph", Graph: s.u.Objects()})
+			return
 		}
+		switch m.Action {
+		case "new", "connect", "disconnect", "set", "destroy", "setDisplay", "seed", "maxDelay":
+			s.changed[c] = true
+		case "reseed", "file", "steps":
+			// Only the Session knows the new seed, whether the
+			// file loaded, or which inputs were disconnected,
+			// so send the graph to c, too.
+			s.changed[nil] = true
+		case "endGroup":
+		default:
+			return
+		}
+		s.flush(c)
 	}()
 	switch a := m.Action; a {
 	case "new":
-		s.u.NewObject(m.Name, m.Kind, m.Value)
+		return s.u.NewObject(m.Name, m.Kind, m.Value)
 	case "connect":
 		return s.u.Connect(m.From, m.To, m.Input)
 	case "disconnect":
@@ -163,20 +418,78 @@ func (s *Session) Handle(m *Message) (err error) {
 		filename := filepath.Join(filePrefix, m.Name)
 		switch a {
 		case "load":
-			if err := s.u.Stop(); err != nil {
-				return err
+			if m.Value < 0 {
+				return fmt.Errorf("bad crossfade time: %v", m.Value)
 			}
-			if err := s.u.Load(filename); err != nil {
+			objs, err := lang.ReadFile(filename)
+			if err != nil {
 				return err
 			}
-			return s.u.Start()
+			fade := time.Duration(m.Value * float64(time.Second))
+			return s.u.LoadObjects(objs, fade)
 		case "save":
-			return s.u.Save(filename)
+			return lang.WriteFile(filename, s.u.Objects())
 		}
 	case "setDisplay":
 		return s.u.SetDisplay(m.Name, m.Display)
+	case "seed":
+		return s.u.SetSeed(m.Name, m.Seed)
+	case "reseed":
+		return s.u.SetSeed(m.Name, rand.Int63n(1<<53))
+	case "file":
+		return s.u.SetFile(m.Name, m.File)
+	case "steps":
+		return s.u.SetSteps(m.Name, m.Steps)
+	case "maxDelay":
+		return s.u.SetMaxDelay(m.Name, m.MaxDelay)
+	case "undo":
+		return s.u.Undo()
+	case "redo":
+		return s.u.Redo()
+	case "beginGroup":
+		s.u.BeginGroup()
+	case "endGroup":
+		if !s.u.InGroup() {
+			return errors.New("endGroup without beginGroup")
+		}
+		return s.u.EndGroup()
+	case "startRecording":
+		return s.startRecording()
+	case "stopRecording":
+		err := s.stopRecording()
+		s.broadcast(&Message{Action: "recording"}, nil)
+		return err
 	default:
 		return fmt.Errorf("unrecognized Action: %v", a)
 	}
 	return nil
 }
+
+func (s *Session) startRecording() error {
+	if s.rec != nil {
+		return errors.New("already recording")
+	}
+	name := "sigourney-" + time.Now().Format("20060102-150405.000") + ".wav"
+	rec, err := s.u.Record(filepath.Join(RecordDir, name), RecordFormat)
+	if err != nil {
+		return err
+	}
+	s.rec, s.recName = rec, name
+	s.broadcast(&Message{Action: "recording", Name: name}, nil)
+	return nil
+}
+
+func (s *Session) stopRecording() error {
+	if s.rec == nil {
+		return nil
+	}
+	rec := s.rec
+	s.rec = nil
+	if err := rec.Close(); err != nil {
+		return err
+	}
+	if n := rec.Dropped(); n > 0 {
+		return fmt.Errorf("recording dropped %v sample frames", n)
+	}
+	return nil
+}
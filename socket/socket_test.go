@@ -0,0 +1,346 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package socket
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/lang"
+	"github.com/nf/sigourney/ui"
+	"github.com/nf/sigourney/wav"
+)
+
+func init() {
+	NewBackend = audio.NewNullBackend
+}
+
+type testClient struct {
+	t *testing.T
+	c *websocket.Conn
+}
+
+func dial(t *testing.T, url string) *testClient {
+	h := http.Header{"Origin": {url}}
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t, c}
+}
+
+func (c *testClient) send(m *Message) {
+	if err := c.c.WriteJSON(m); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads the next message, which must have the given action.
+func (c *testClient) expect(action string) *Message {
+	c.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m := new(Message)
+	if err := c.c.ReadJSON(m); err != nil {
+		c.t.Fatalf("reading %q: %v", action, err)
+	}
+	if m.Action != action {
+		c.t.Fatalf("got %q message (%v), want %q", m.Action, m.Message, action)
+	}
+	return m
+}
+
+// hasObject reports whether the graph includes the named object.
+func hasObject(m *Message, name string) bool {
+	for _, o := range m.Graph {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSharedSession(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(Handler))
+	defer srv.Close()
+
+	a := dial(t, srv.URL)
+	defer a.c.Close()
+	a.expect("hello")
+	a.expect("setGraph")
+
+	// A change by one client is seen by the clients that join later.
+	// Wait for the change to reach another client before joining.
+	w := dial(t, srv.URL)
+	w.expect("hello")
+	w.expect("setGraph")
+	a.send(&Message{Action: "new", Name: "sin1", Kind: "sin"})
+	w.expect("setGraph")
+	w.c.Close()
+	b := dial(t, srv.URL)
+	defer b.c.Close()
+	b.expect("hello")
+	if m := b.expect("setGraph"); !hasObject(m, "sin1") {
+		t.Errorf("joining client's graph lacks sin1: %v", m.Graph)
+	}
+
+	// A group of changes is sent to the others when it ends.
+	b.send(&Message{Action: "beginGroup"})
+	b.send(&Message{Action: "new", Name: "sin2", Kind: "sin"})
+	b.send(&Message{Action: "connect", From: "sin2", To: "sin1", Input: "pitch"})
+	b.send(&Message{Action: "endGroup"})
+	if m := a.expect("setGraph"); !hasObject(m, "sin2") {
+		t.Errorf("graph lacks sin2: %v", m.Graph)
+	}
+
+	// Errors go only to the client that caused them,
+	// along with the graph, which the client may have changed.
+	b.send(&Message{Action: "destroy", Name: "bogus"})
+	b.expect("message")
+	b.expect("setGraph")
+
+	// A client that picks a name another client has taken
+	// is told of the other's object, and loses its own.
+	a.send(&Message{Action: "new", Name: "sin3", Kind: "sin"})
+	b.expect("setGraph")
+	b.send(&Message{Action: "new", Name: "sin3", Kind: "noise"})
+	b.expect("message")
+	for _, o := range b.expect("setGraph").Graph {
+		if o.Name == "sin3" && o.Kind != "sin" {
+			t.Errorf("sin3 is a %v, want a sin", o.Kind)
+		}
+	}
+	a.send(&Message{Action: "undo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); hasObject(m, "sin3") || !hasObject(m, "sin2") {
+			t.Errorf("graph after undo of sin3: %v", m.Graph)
+		}
+	}
+
+	// Undo is seen by everyone.
+	b.send(&Message{Action: "undo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); hasObject(m, "sin2") {
+			t.Errorf("graph after undo includes sin2: %v", m.Graph)
+		}
+	}
+
+	// Groups belong to the client that began them. The changes of other
+	// clients are sent at once, and are undone on their own.
+	b.send(&Message{Action: "beginGroup"})
+	b.send(&Message{Action: "new", Name: "sin6", Kind: "sin"})
+	b.send(&Message{Action: "undo"})
+	b.expect("message") // Can't undo inside a group.
+	b.expect("setGraph")
+	a.send(&Message{Action: "new", Name: "sin7", Kind: "sin"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); !hasObject(m, "sin7") {
+			t.Errorf("graph lacks sin7: %v", m.Graph)
+		}
+	}
+	a.send(&Message{Action: "undo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); hasObject(m, "sin7") || !hasObject(m, "sin6") {
+			t.Errorf("graph after undo of sin7: %v", m.Graph)
+		}
+	}
+	b.send(&Message{Action: "endGroup"})
+	b.send(&Message{Action: "undo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); hasObject(m, "sin6") {
+			t.Errorf("graph after undo of group includes sin6: %v", m.Graph)
+		}
+	}
+
+	// Each client undoes its own changes, even when another client's
+	// are more recent.
+	a.send(&Message{Action: "new", Name: "sin10", Kind: "sin"})
+	b.expect("setGraph")
+	b.send(&Message{Action: "new", Name: "sin11", Kind: "sin"})
+	a.expect("setGraph")
+	a.send(&Message{Action: "undo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); hasObject(m, "sin10") || !hasObject(m, "sin11") {
+			t.Errorf("graph after a's undo of sin10: %v", m.Graph)
+		}
+	}
+	b.send(&Message{Action: "undo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); hasObject(m, "sin11") {
+			t.Errorf("graph after b's undo of sin11: %v", m.Graph)
+		}
+	}
+	a.send(&Message{Action: "redo"})
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); !hasObject(m, "sin10") || hasObject(m, "sin11") {
+			t.Errorf("graph after a's redo of sin10: %v", m.Graph)
+		}
+	}
+
+	// A new seed is sent to everyone, including the client that asked.
+	a.send(&Message{Action: "new", Name: "noise3", Kind: "noise"})
+	b.expect("setGraph")
+	a.send(&Message{Action: "reseed", Name: "noise3"})
+	for _, c := range []*testClient{a, b} {
+		m := c.expect("setGraph")
+		for _, o := range m.Graph {
+			if o.Name == "noise3" && o.Seed == ui.DefaultSeed("noise3") {
+				t.Errorf("noise3 wasn't reseeded: %v", o.Seed)
+			}
+		}
+	}
+
+	// So is the file of a sampler, if it loads.
+	dir, err := ioutil.TempDir("", "sigourney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { audio.SampleDir = d }(audio.SampleDir)
+	audio.SampleDir = dir
+	f, err := os.Create(filepath.Join(dir, "hit.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := wav.NewEncoder(f, wav.PCM16, 44100, 1)
+	if err == nil {
+		err = enc.Close()
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.send(&Message{Action: "new", Name: "sampler4", Kind: "sampler"})
+	b.expect("setGraph")
+	a.send(&Message{Action: "file", Name: "sampler4", File: "missing.wav"})
+	a.expect("message")
+	a.expect("setGraph")
+	a.send(&Message{Action: "file", Name: "sampler4", File: "hit.wav"})
+	for _, c := range []*testClient{a, b} {
+		m := c.expect("setGraph")
+		for _, o := range m.Graph {
+			if o.Name == "sampler4" && o.File != "hit.wav" {
+				t.Errorf("sampler4 plays %q, want hit.wav", o.File)
+			}
+		}
+	}
+
+	// And the number of steps of a sequencer, which may disconnect inputs.
+	a.send(&Message{Action: "new", Name: "sequencer5", Kind: "sequencer"})
+	b.expect("setGraph")
+	a.send(&Message{Action: "steps", Name: "sequencer5", Steps: 16})
+	for _, c := range []*testClient{a, b} {
+		m := c.expect("setGraph")
+		for _, o := range m.Graph {
+			if o.Name == "sequencer5" && o.Steps != 16 {
+				t.Errorf("sequencer5 has %v steps, want 16", o.Steps)
+			}
+		}
+	}
+
+	// And the maximum delay of a delay line.
+	a.send(&Message{Action: "new", Name: "delayline9", Kind: "delayline"})
+	b.expect("setGraph")
+	a.send(&Message{Action: "maxDelay", Name: "delayline9", MaxDelay: 20})
+	m := b.expect("setGraph")
+	for _, o := range m.Graph {
+		if o.Name == "delayline9" && o.MaxDelay != 20 {
+			t.Errorf("delayline9's maximum delay is %v, want 20", o.MaxDelay)
+		}
+	}
+
+	// Changes made through Handle are sent to every client.
+	sharedMu.Lock()
+	s := shared
+	sharedMu.Unlock()
+	if err := s.Handle(&Message{Action: "new", Name: "sin8", Kind: "sin"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*testClient{a, b} {
+		if m := c.expect("setGraph"); !hasObject(m, "sin8") {
+			t.Errorf("graph lacks sin8: %v", m.Graph)
+		}
+	}
+	if err := s.Handle(&Message{Action: "destroy", Name: "bogus"}); err == nil {
+		t.Error("Handle of bad destroy succeeded")
+	}
+}
+
+func TestGraphHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigourney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Mkdir(filePrefix, 0777); err != nil {
+		t.Fatal(err)
+	}
+	objs := []*ui.Object{
+		{Name: "engine", Kind: "engine", Input: map[string]string{"in": "sin1"}},
+		{Name: "sin1", Kind: "sin"},
+	}
+	if err := lang.WriteFile(filepath.Join(filePrefix, "p1"), objs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query string
+		code  int
+		ctype string
+	}{
+		{"patch=p1", http.StatusOK, "text/vnd.graphviz; charset=utf-8"},
+		{"patch=p1&format=dot", http.StatusOK, "text/vnd.graphviz; charset=utf-8"},
+		{"patch=..%2Fp1", http.StatusBadRequest, ""},
+		{"patch=missing", http.StatusNotFound, ""},
+		{"patch=p1&format=bogus", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/graph?"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		GraphHandler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%v: status %v, want %v: %s", test.query, w.Code, test.code, w.Body)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != test.ctype {
+			t.Errorf("%v: Content-Type %q, want %q", test.query, ct, test.ctype)
+		}
+		if b := w.Body.String(); !strings.HasPrefix(b, "digraph patch {") || !strings.Contains(b, "sin1") {
+			t.Errorf("%v: body doesn't describe the patch:\n%s", test.query, b)
+		}
+	}
+}
@@ -26,7 +26,14 @@ Sigourney.UI = function() {
 	ui.changedSinceSave = false;
 
 	var kindInputs = {};
+	var kindOutputs = {};
+	var kindInputInfo = {};
+	var kindRandom = {};
+	var kindFile = {};
+	var kindSteps = {};
+	var kindDelay = {};
 	var colorIndex = 0;
+	var recordButton;
 
 	jsPlumb.bind('ready', function() {
 		$('#status').text('Connecting to back end...');
@@ -48,13 +55,16 @@ Sigourney.UI = function() {
 		if (Sigourney.Debug) console.log("<", m);
 		switch (m.Action) {
 			case 'hello':
-				handleHello(m.KindInputs);
+				handleHello(m.Kinds);
 				break;
 			case 'setGraph':
 				plumb.doWhileSuspended(function() {
 					handleSetGraph(m.Graph);
 				});
 				break;
+			case 'recording':
+				handleRecording(m.Name);
+				break;
 			case 'message':
 				var div = $('<div></div>').text(m.Message);
 				$('#status').append(div);
@@ -66,22 +76,28 @@ Sigourney.UI = function() {
 	function initPlumb() {
 		ui.plumb = plumb = jsPlumb.getInstance({Container: 'page'});
 		plumb.bind('connection', function(conn) {
+			if (ui.suspended) return;
 			var source = ui.objects[conn.sourceId];
 			var target = ui.objects[conn.targetId];
 			var input = conn.targetEndpoint.getParameter('input');
-			if (target.inputs[input] != source.name) {
-				target.inputs[input] = source.name;
-				ui.send({Action: 'connect', From: source.name, To: target.name, Input: input});
+			var output = conn.sourceEndpoint.getParameter('output');
+			var from = output ? source.name + '.' + output : source.name;
+			if (target.inputs[input] != from) {
+				target.inputs[input] = from;
+				ui.send({Action: 'connect', From: from, To: target.name, Input: input});
 				ui.changedSinceSave = true;
 			}
 		});
 		plumb.bind('connectionDetached', function(conn) {
+			if (ui.suspended) return;
 			if (!conn.targetEndpoint.isTarget) return;
 			var target = ui.objects[conn.targetId];
 			var source = ui.objects[conn.sourceId];
 			var input = conn.targetEndpoint.getParameter('input');
 			target.inputs[input] = null;
-			ui.send({Action: 'disconnect', From: conn.source.id, To: conn.target.id, Input: input});
+			var output = conn.sourceEndpoint.getParameter('output');
+			var from = output ? conn.source.id + '.' + output : conn.source.id;
+			ui.send({Action: 'disconnect', From: from, To: conn.target.id, Input: input});
 			ui.changedSinceSave = true;
 		});
 		plumb.bind('click', function(conn, e) {
@@ -93,32 +109,39 @@ Sigourney.UI = function() {
 	function initUI() {
 		var fn = $('<input type="text"/>');
 		var load = $('<input type="button" value="load"/>');
+		var fade = $('<input type="text" placeholder="fade (s)"/>')
+			.attr('title', 'time to crossfade to a loaded patch, in seconds');
 		var save = $('<input type="button" value="save"/>');
-		$('#control').append(fn, load, save);
+		var record = $('<input type="button" value="record"/>');
+		$('#control').append(fn, load, fade, save, record);
+		recordButton = record;
 
 		var loadFn  = function() {
 			var changeWarning = "There are unsaved changes!\nOK to continue?";
 			if (ui.changedSinceSave && !confirm(changeWarning)) return;
-			for (var name in ui.objects) {
-				ui.objects[name].destroy();
-			}
-			ui.objects = {};
-			ui.send({Action: 'load', Name: fn.val()});
+			// The back end replies with the new graph.
+			ui.send({Action: 'load', Name: fn.val(), Value: parseFloat(fade.val()) || 0});
 			fn.blur();
 			load.blur();
 			ui.changedSinceSave = false;
 		};
 		fn.keypress(function(e) { if (e.charCode == 13) loadFn(); });
+		fade.keypress(function(e) { if (e.charCode == 13) loadFn(); });
 		load.click(loadFn);
 		save.click(function() {
 			ui.send({Action: 'save', Name: fn.val()});
 			save.blur();
 			ui.changedSinceSave = false;
 		});
+		record.click(function() {
+			var a = record.hasClass('recording') ? 'stopRecording' : 'startRecording';
+			ui.send({Action: a});
+			record.blur();
+		});
 
-		// Handle keypresses while fn field is not focused.
+		// Handle keypresses while the text fields are not focused.
 		$(document).keypress(function(e) {
-			if (fn.is(':focus'))
+			if (fn.is(':focus') || fade.is(':focus'))
 				return;
 			switch (e.charCode) {
 			case 100: // d
@@ -127,6 +150,14 @@ Sigourney.UI = function() {
 			case 24: // ^x
 				onDelete();
 				break;
+			case 25: // ^y
+				ui.send({Action: 'redo'});
+				ui.changedSinceSave = true;
+				break;
+			case 26: // ^z
+				ui.send({Action: 'undo'});
+				ui.changedSinceSave = true;
+				break;
 			default:
 				return;
 			}
@@ -143,14 +174,24 @@ Sigourney.UI = function() {
 		$('#page').selectable({filter: ".object"})
 	}
 
-	function handleHello(inputs) {
-		for (var k in inputs) {
-			kindInputs[k] = inputs[k];
-			if (k == "engine") {
-				createObject(k, {offset: engineOffset()});
-			} else {
-				addKind(k, inputs[k]);
-			}
+	function handleRecording(name) {
+		var record = recordButton;
+		record.toggleClass('recording', !!name);
+		record.val(name ? 'stop' : 'record');
+		if (name) record.attr('title', name);
+		else record.removeAttr('title');
+	}
+
+	function handleHello(kinds) {
+		for (var k in kinds) {
+			kindInputs[k] = kinds[k].Inputs;
+			kindOutputs[k] = kinds[k].Outputs;
+			kindInputInfo[k] = kinds[k].InputInfo || {};
+			kindRandom[k] = kinds[k].Random || false;
+			kindFile[k] = kinds[k].File || false;
+			kindSteps[k] = kinds[k].Steps || false;
+			kindDelay[k] = kinds[k].Delay || false;
+			if (k != "engine") addKind(k, kinds[k]);
 		}
 	}
 
@@ -159,8 +200,9 @@ Sigourney.UI = function() {
 		return {top: 3*h/4, left: w/2-(49+20+20+1+1)/2};
 	}
 
-	function addKind(kind, inputs) {
-		$('<li></li>').text(kind).data('inputs', inputs)
+	function addKind(kind, info) {
+		$('<li></li>').text(kind).data('inputs', info.Inputs)
+			.attr('title', info.Doc || '')
 			.addClass('kind-'+kind)
 			.appendTo('#objects')
 			.draggable({
@@ -173,10 +215,22 @@ Sigourney.UI = function() {
 			});
 	}
 
+	// handleSetGraph replaces the displayed objects with those in graph.
 	function handleSetGraph(graph) {
+		ui.suspended = true;
+		for (var name in ui.objects) {
+			ui.objects[name].destroy();
+		}
+		ui.objects = {};
 		for (var i = 0; i < graph.length; i++) {
 			var o = graph[i];
 			bumpNCount(o.Name);
+			if (o.Kind == "engine" && !(o.Display && o.Display.offset)) {
+				// The first client to see a new session places the engine.
+				o.Display = {offset: engineOffset()};
+				ui.onDisplayUpdate(newObject(o));
+				continue;
+			}
 			newObject(o);
 		}
 		for (var i = 0; i < graph.length; i++) {
@@ -184,10 +238,22 @@ Sigourney.UI = function() {
 			for (var input in o.Input) {
 				var from = o.Input[input];
 				if (!from) continue;
-				plumb.connect({uuids: [from + '-out', o.Name + '-' + input]});
-				ui.objects[o.Name].inputs[input] = from
+				ui.objects[o.Name].inputs[input] = from;
+				plumb.connect({uuids: [outputUUID(from), o.Name + '-' + input]});
 			}
 		}
+		ui.suspended = false;
+	}
+
+	// outputUUID returns the uuid of the endpoint for a connection
+	// source of the form "object" or "object.output".
+	function outputUUID(from) {
+		var i = from.indexOf('.');
+		if (i < 0) return from + '-out';
+		var name = from.substr(0, i), output = from.substr(i+1);
+		var outputs = kindOutputs[ui.objects[name].kind];
+		if (outputs && outputs[0] == output) return name + '-out';
+		return name + '-out-' + output;
 	}
 
 	var nCount = 0;
@@ -201,35 +267,60 @@ Sigourney.UI = function() {
 		}
 	}
 
-	function createObject(kind, display) {
+	function createObject(kind, display, steps) {
 		nCount++;
 		var name = kind + nCount;
 		if (kind == "engine")
 			name = "engine";
 
-		var obj = newObject({Name: name, Kind: kind, Display: display});
+		var obj = newObject({Name: name, Kind: kind, Display: display, Steps: steps});
 
+		ui.send({Action: 'beginGroup'});
 		if (kind != "engine") {
 			var m = {Action: 'new', Name: name, Kind: kind};
 			if (kind == "value")
 				m.Value = obj.value;
 			ui.send(m);
+			if (steps)
+				ui.send({Action: 'steps', Name: name, Steps: steps});
 		}
 		ui.onDisplayUpdate(obj);
+		ui.send({Action: 'endGroup'});
 
 		return obj;
 	}
 
+	// stepInputs returns the inputs of an object with the given number of
+	// steps, given the inputs of its kind, some of which are numbered.
+	function stepInputs(kInputs, steps) {
+		var a = [], seen = {};
+		for (var i = 0; i < kInputs.length; i++) {
+			var m = /^(.*\D)\d+$/.exec(kInputs[i]);
+			if (m === null) {
+				a.push(kInputs[i]);
+				continue;
+			}
+			if (seen[m[1]]) continue;
+			seen[m[1]] = true;
+			for (var j = 0; j < steps; j++) {
+				a.push(m[1] + j);
+			}
+		}
+		return a;
+	}
+
 	function newObject(b) {
 		var inputs = {};
 		var kInputs = kindInputs[b.Kind];
+		if (kInputs != null && kindSteps[b.Kind] && b.Steps)
+			kInputs = stepInputs(kInputs, b.Steps);
 		if (kInputs != null) {
 			for (var i = 0; i < kInputs.length; i++) {
 				inputs[kInputs[i]] = null;
 			}
 		}
 
-		var obj = new Sigourney.Object(ui, b, inputs);
+		var obj = new Sigourney.Object(ui, b, inputs, kindOutputs[b.Kind], kindInputInfo[b.Kind], kindRandom[b.Kind], kindFile[b.Kind], kindSteps[b.Kind], kindDelay[b.Kind]);
 		ui.objects[b.Name] = obj;
 		obj.element();
 
@@ -238,6 +329,7 @@ Sigourney.UI = function() {
 
 	function onDup() {
 		var names = {};
+		ui.send({Action: 'beginGroup'});
 		$('.ui-selected').not('#engine').each(function() {
 			// duplicate objects
 			var obj1 = $(this).data('object');
@@ -245,32 +337,45 @@ Sigourney.UI = function() {
 			var o2 = {top: o1.top + 50, left: o1.left + 50};
 			var d = {};
 			$.extend(true, d, obj1.display, {offset: o2});
-			var obj2 = createObject(obj1.kind, d);
+			var obj2 = createObject(obj1.kind, d, obj1.steps);
 			names[obj1.name] = obj2.name;
 			obj2.element().addClass('ui-selected');
 			if (obj1.kind == 'value') {
 				obj2.setValue(obj1.value);
 				ui.onSetValue(obj2);
 			}
+			if (obj1.file)
+				ui.onSetFile(obj2, obj1.file);
+			if (obj1.maxDelay)
+				ui.onSetMaxDelay(obj2, obj1.maxDelay);
 		}).each(function() {
 			// connect new objects
 			var obj = $(this).data('object');
 			for (var input in obj.inputs) {
+				var from = obj.inputs[input];
+				if (!from)
+					continue;
 				var targetName = names[obj.name];
-				var sourceName = names[obj.inputs[input]];
+				var i = from.indexOf('.');
+				var sourceName = names[i < 0 ? from : from.substr(0, i)];
 				if (!sourceName)
 					continue;
-				plumb.connect({uuids: [sourceName + '-out', targetName + '-' + input]});
+				if (i >= 0)
+					sourceName += from.substr(i);
+				plumb.connect({uuids: [outputUUID(sourceName), targetName + '-' + input]});
 			}
 		}).removeClass('ui-selected');
+		ui.send({Action: 'endGroup'});
 	}
 
 	function onDelete() {
+		ui.send({Action: 'beginGroup'});
 		$('.ui-selected').not('#engine').each(function() {
 			var obj = $(this).data('object');
 			obj.destroy();
 			ui.onDestroy(obj);
 		});
+		ui.send({Action: 'endGroup'});
 	}
 };
 
@@ -289,22 +394,55 @@ Sigourney.UI.prototype.onSetValue = function(obj) {
 	this.changedSinceSave = true;
 };
 
+Sigourney.UI.prototype.onSetSeed = function(obj, seed) {
+	obj.seed = seed;
+	obj.el.attr('title', 'seed ' + seed);
+	this.send({Action: 'seed', Name: obj.name, Seed: seed});
+	this.changedSinceSave = true;
+};
+
+Sigourney.UI.prototype.onSetFile = function(obj, file) {
+	// The graph sent in reply carries the file, if it loaded.
+	this.send({Action: 'file', Name: obj.name, File: file});
+	this.changedSinceSave = true;
+};
+
+Sigourney.UI.prototype.onSetSteps = function(obj, steps) {
+	// The graph sent in reply has the object's new inputs.
+	this.send({Action: 'steps', Name: obj.name, Steps: steps});
+	this.changedSinceSave = true;
+};
+
+Sigourney.UI.prototype.onSetMaxDelay = function(obj, seconds) {
+	obj.maxDelay = seconds;
+	obj.el.attr('title', 'max ' + seconds + 's');
+	this.send({Action: 'maxDelay', Name: obj.name, MaxDelay: seconds});
+	this.changedSinceSave = true;
+};
+
 Sigourney.UI.prototype.onDestroy = function(obj) {
 	this.send({Action: 'destroy', Name: obj.name});
 	this.changedSinceSave = true;
 	delete(objects[obj.name]);
 };
 
-Sigourney.Object = function(ui, b, inputs) {
+Sigourney.Object = function(ui, b, inputs, outputs, inputInfo, random, file, steps, delay) {
 	this.ui = ui;
 	this.el = null;
 
 	this.name = b.Name;
 	this.kind = b.Kind;
 	this.value = b.Value || 0;
+	this.seed = b.Seed || 0;
+	this.random = random || false;
+	this.file = file ? b.File || "" : null;
+	this.steps = steps ? b.Steps || 0 : null;
+	this.maxDelay = delay ? b.MaxDelay || 0 : null;
 	this.display = b.Display || {};
 
 	this.inputs = inputs;
+	this.outputs = outputs;
+	this.inputInfo = inputInfo || {};
 };
 
 var endpointCommon = {
@@ -364,16 +502,18 @@ Sigourney.Object.prototype.element = function() {
 			});
 		},
 		stop: function() {
+			ui.send({Action: 'beginGroup'});
 			obj.updateOffset();
 			ui.onDisplayUpdate(obj);
-			if (!$(this).is('.ui-selected'))
-				return;
-			$('.ui-selected').not(this).each(function() {
-				plumb.repaint(this);
-				var obj = $(this).data('object');
-				obj.updateOffset();
-				ui.onDisplayUpdate(obj);
-			});
+			if ($(this).is('.ui-selected')) {
+				$('.ui-selected').not(this).each(function() {
+					plumb.repaint(this);
+					var obj = $(this).data('object');
+					obj.updateOffset();
+					ui.onDisplayUpdate(obj);
+				});
+			}
+			ui.send({Action: 'endGroup'});
 		}
 	});
 
@@ -392,6 +532,49 @@ Sigourney.Object.prototype.element = function() {
 		});
 	}
 
+	if (obj.random) {
+		if (obj.seed) obj.el.attr('title', 'seed ' + obj.seed);
+		obj.el.dblclick(function(e) {
+			// Objects with steps take Alt-double-click to seed them.
+			if (obj.steps != null && !e.altKey) return;
+			var v = window.prompt("Seed? (empty for a random one)", obj.seed || "");
+			if (v == null) return;
+			if (v == "") {
+				ui.send({Action: 'reseed', Name: obj.name});
+				ui.changedSinceSave = true;
+			} else if (/^[0-9]+$/.test(v)) {
+				ui.onSetSeed(obj, parseInt(v, 10));
+			}
+		});
+	}
+
+	if (obj.steps != null) {
+		obj.el.dblclick(function(e) {
+			if (e.altKey && obj.random) return;
+			var v = window.prompt("Steps? (1 to 64)", obj.steps || "");
+			if (v == null || !/^[0-9]+$/.test(v)) return;
+			ui.onSetSteps(obj, parseInt(v, 10));
+		});
+	}
+
+	if (obj.maxDelay != null) {
+		if (obj.maxDelay) obj.el.attr('title', 'max ' + obj.maxDelay + 's');
+		obj.el.dblclick(function(e) {
+			var v = window.prompt("Longest delay? (seconds, up to 60)", obj.maxDelay || "");
+			if (v == null || !(v*1 > 0)) return;
+			ui.onSetMaxDelay(obj, v*1);
+		});
+	}
+
+	if (obj.file != null) {
+		if (obj.file) obj.el.attr('title', obj.file);
+		obj.el.dblclick(function(e) {
+			var v = window.prompt("WAV file? (empty for none)", obj.file);
+			if (v == null) return;
+			ui.onSetFile(obj, v);
+		});
+	}
+
 	if (obj.kind != "engine") {
 		obj.el.click(function(e) {
 			if (!e.shiftKey) return;
@@ -404,7 +587,7 @@ Sigourney.Object.prototype.element = function() {
 	plumb.doWhileSuspended(function() {
 		if (obj.inputs) {
 			for (var input in obj.inputs) {
-				plumb.addEndpoint(obj.el, {
+				var ep = plumb.addEndpoint(obj.el, {
 					uuid: obj.name + '-' + input,
 					parameters: {input: input},
 					anchor: "ContinuousTop",
@@ -417,9 +600,32 @@ Sigourney.Object.prototype.element = function() {
 						} ]
 					]
 				}, endpointCommon);
+				var info = obj.inputInfo[input];
+				if (info)
+					$(ep.canvas).attr('title', Sigourney.describeInput(input, info));
 			}
 		}
-		if (obj.kind != "engine") {
+		if (obj.outputs) {
+			var n = obj.outputs.length;
+			for (var i = 0; i < n; i++) {
+				var output = obj.outputs[i];
+				plumb.addEndpoint(obj.el, {
+					uuid: obj.name + '-out' + (i > 0 ? '-' + output : ''),
+					parameters: {output: output},
+					anchor: [(i+1)/(n+1), 1, 0, 1],
+					isSource: true,
+					isTarget: false,
+					maxConnections: -1,
+					overlays: [
+						[ 'Label', {
+							label: output,
+							location: [0.5, 1.5],
+							cssClass: 'label'
+						} ]
+					]
+				}, endpointCommon);
+			}
+		} else if (obj.kind != "engine") {
 			plumb.addEndpoint(obj.el, {
 				uuid: obj.name + '-out',
 				anchor: "Bottom",
@@ -453,6 +659,17 @@ Sigourney.Object.prototype.destroy = function() {
 	this.ui.plumb.remove($(this.el));
 }
 
+// describeInput returns a one-line description of an input
+// from its metadata.
+Sigourney.describeInput = function(input, info) {
+	var s = input;
+	if (info.Doc) s += ': ' + info.Doc;
+	if (info.Unit) s += ' (' + info.Unit + ')';
+	if (info.Min != 0 || info.Max != 0)
+		s += ' [' + info.Min + ' to ' + info.Max + ']';
+	return s;
+}
+
 Sigourney.noteToValue = function(note) {
 	var n = /^([a-zA-Z])(#)?([0-9]+)$/.exec(note);
 	if (n == null) return null;
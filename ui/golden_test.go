@@ -0,0 +1,181 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui_test
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/lang"
+	"github.com/nf/sigourney/ui"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden fingerprints of the saved patches")
+
+const (
+	goldenFile     = "testdata/golden.json"
+	goldenSeconds  = 2
+	goldenSegments = 20
+	goldenTol      = 1e-6
+)
+
+// A fingerprint summarizes the sound of a patch: the mean and
+// root mean square of each of a number of equal segments, and the peak.
+type fingerprint struct {
+	Mean, RMS []float64
+	Peak      float64
+}
+
+func newFingerprint(s []audio.Sample) *fingerprint {
+	f := new(fingerprint)
+	n := len(s) / goldenSegments
+	for i := 0; i < goldenSegments; i++ {
+		var sum, sq float64
+		for _, v := range s[i*n : (i+1)*n] {
+			sum += float64(v)
+			sq += float64(v * v)
+			f.Peak = math.Max(f.Peak, math.Abs(float64(v)))
+		}
+		f.Mean = append(f.Mean, sum/float64(n))
+		f.RMS = append(f.RMS, math.Sqrt(sq/float64(n)))
+	}
+	return f
+}
+
+// diff returns a description of the first difference between
+// f and g that exceeds goldenTol, or the empty string.
+func (f *fingerprint) diff(g *fingerprint) string {
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) <= goldenTol*(1+math.Abs(b))
+	}
+	if len(f.Mean) != len(g.Mean) || len(f.RMS) != len(g.RMS) {
+		return "different number of segments"
+	}
+	for i := range f.Mean {
+		if !near(f.Mean[i], g.Mean[i]) {
+			return fmt.Sprintf("segment %d: mean %v, want %v", i, f.Mean[i], g.Mean[i])
+		}
+		if !near(f.RMS[i], g.RMS[i]) {
+			return fmt.Sprintf("segment %d: RMS %v, want %v", i, f.RMS[i], g.RMS[i])
+		}
+	}
+	if !near(f.Peak, g.Peak) {
+		return fmt.Sprintf("peak %v, want %v", f.Peak, g.Peak)
+	}
+	return ""
+}
+
+type discard struct{}
+
+func (discard) Hello(map[string]*ui.Kind) {}
+func (discard) SetGraph([]*ui.Object)     {}
+
+// holdNote replaces the objects that play notes from a MIDI device
+// with values, as if A5 were held down from the start,
+// so that patches played from a MIDI device aren't silent.
+func holdNote(objs []*ui.Object) {
+	for _, o := range objs {
+		switch o.Kind {
+		case "gate":
+			o.Kind, o.Value = "value", 1
+		case "note":
+			o.Kind, o.Value = "value", (81-69)/120.0
+		}
+	}
+}
+
+// render plays the objects of the named patch for goldenSeconds.
+func render(t *testing.T, name string, objs []*ui.Object) []audio.Sample {
+	u := ui.New(discard{})
+	if err := u.LoadObjects(objs, 0); err != nil {
+		t.Fatalf("%v: %v", name, err)
+	}
+	frames := goldenSeconds * u.SampleRate() / u.FrameLength()
+	return u.Render(frames)
+}
+
+func TestGolden(t *testing.T) {
+	names, err := filepath.Glob("../patch/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+
+	golden := make(map[string]*fingerprint)
+	if b, err := ioutil.ReadFile(goldenFile); err == nil {
+		if err := json.Unmarshal(b, &golden); err != nil {
+			t.Fatal(err)
+		}
+	} else if !*update {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]*fingerprint)
+	for _, name := range names {
+		base := filepath.Base(name)
+		objs, err := lang.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		holdNote(objs)
+		f := newFingerprint(render(t, name, objs))
+		if f.Peak == 0 {
+			t.Errorf("%v: silent", name)
+			continue
+		}
+		got[base] = f
+		if *update {
+			continue
+		}
+		want, ok := golden[base]
+		if !ok {
+			t.Errorf("%v: no golden fingerprint; run go test -update", name)
+			continue
+		}
+		if d := f.diff(want); d != "" {
+			t.Errorf("%v: %v", name, d)
+		}
+	}
+
+	if *update {
+		b, err := json.MarshalIndent(got, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(goldenFile, append(b, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	var stale []string
+	for base := range golden {
+		if got[base] == nil {
+			stale = append(stale, base)
+		}
+	}
+	sort.Strings(stale)
+	for _, base := range stale {
+		t.Errorf("golden fingerprint for %v, which isn't tested; run go test -update", base)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui
+
+import "errors"
+
+// history records the changes made to a UI's objects
+// so that they may be undone and redone.
+type history struct {
+	done   []*step // Steps that may be undone, most recent last.
+	undone []*step // Steps that may be redone, most recent last.
+
+	cur       *step // The step being recorded, if any.
+	group     int   // Depth of BeginGroup calls.
+	replaying bool  // Whether changes are being undone or redone.
+	loads     int   // The UI's number of loads when done was last cleared.
+}
+
+// A step holds the changes made by a single user action.
+// Each change is recorded as a pair of functions that make and reverse it.
+type step struct {
+	redo, undo []func() error
+}
+
+// record adds a change to the current step.
+func (u *UI) record(redo, undo func() error) {
+	h := &u.hist
+	if h.replaying || h.cur == nil {
+		return
+	}
+	h.cur.redo = append(h.cur.redo, redo)
+	h.cur.undo = append(h.cur.undo, undo)
+}
+
+// begin starts recording a step, if one isn't already being recorded.
+func (u *UI) begin() {
+	if h := &u.hist; h.cur == nil && !h.replaying {
+		h.cur = &step{}
+	}
+}
+
+// commit finishes recording the current step,
+// unless it is part of a group.
+func (u *UI) commit() {
+	h := &u.hist
+	if h.cur == nil || h.group > 0 {
+		return
+	}
+	if len(h.cur.undo) > 0 {
+		h.done = append(h.done, h.cur)
+		h.undone = nil
+	}
+	h.cur = nil
+}
+
+// mark returns the number of changes in the current step.
+func (h *history) mark() int {
+	if h.cur == nil {
+		return 0
+	}
+	return len(h.cur.undo)
+}
+
+// rollback reverses the changes recorded in the current step
+// since mark was called, most recent first, and forgets them.
+func (u *UI) rollback(mark int) {
+	h := &u.hist
+	if h.cur == nil {
+		return
+	}
+	undo := h.cur.undo[mark:]
+	h.cur.redo, h.cur.undo = h.cur.redo[:mark], h.cur.undo[:mark]
+	replaying := h.replaying
+	h.replaying = true
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i]()
+	}
+	h.replaying = replaying
+}
+
+// BeginGroup starts a group of changes that are undone and redone
+// as one step. Groups end with a call to EndGroup, and may be nested.
+func (u *UI) BeginGroup() {
+	u.begin()
+	u.hist.group++
+}
+
+// EndGroup ends a group of changes started by BeginGroup.
+func (u *UI) EndGroup() error {
+	if u.hist.group == 0 {
+		return errors.New("EndGroup without BeginGroup")
+	}
+	u.hist.group--
+	u.commit()
+	return nil
+}
+
+// InGroup reports whether a group started by BeginGroup is in progress.
+func (u *UI) InGroup() bool {
+	return u.hist.group > 0
+}
+
+// A Group holds the undo history and the groups in progress of one of
+// several editors of a UI, so that each editor's changes are recorded in
+// steps of its own, and undone and redone on their own.
+// The zero Group has no history and no groups in progress.
+type Group struct {
+	hist history
+}
+
+// SwapGroup exchanges the UI's undo history and groups in progress with
+// those held by g. An editor's changes should be bracketed by two calls to
+// SwapGroup with its Group, so that BeginGroup, EndGroup, InGroup, Undo
+// and Redo apply to its own history, and its changes are kept out of
+// other editors' histories. A history recorded before the patch was last
+// loaded is cleared, as its steps refer to the old patch.
+func (u *UI) SwapGroup(g *Group) {
+	u.hist, g.hist = g.hist, u.hist
+	if h := &u.hist; h.loads != u.loads {
+		h.done, h.undone, h.loads = nil, nil, u.loads
+		if h.cur != nil {
+			h.cur = &step{}
+		}
+	}
+}
+
+// Undo reverses the most recent step and sends the resulting graph
+// to the Handler. A step that can't be reversed, as another editor has
+// since changed the objects it refers to, is dropped from the history,
+// so that the steps before it may still be undone.
+func (u *UI) Undo() error {
+	h := &u.hist
+	if h.group > 0 {
+		return errors.New("can't undo inside a group")
+	}
+	if len(h.done) == 0 {
+		return errors.New("nothing to undo")
+	}
+	s := h.done[len(h.done)-1]
+	n := len(s.undo)
+	fs, inv := make([]func() error, n), make([]func() error, n)
+	for i := range s.undo {
+		fs[n-1-i], inv[n-1-i] = s.undo[i], s.redo[i]
+	}
+	h.done = h.done[:len(h.done)-1]
+	if err := u.replay(fs, inv); err != nil {
+		return err
+	}
+	h.undone = append(h.undone, s)
+	return nil
+}
+
+// Redo reapplies the most recently undone step and sends the resulting
+// graph to the Handler. Like Undo, it drops a step that can't be replayed.
+func (u *UI) Redo() error {
+	h := &u.hist
+	if h.group > 0 {
+		return errors.New("can't redo inside a group")
+	}
+	if len(h.undone) == 0 {
+		return errors.New("nothing to redo")
+	}
+	s := h.undone[len(h.undone)-1]
+	h.undone = h.undone[:len(h.undone)-1]
+	if err := u.replay(s.redo, s.undo); err != nil {
+		return err
+	}
+	h.done = append(h.done, s)
+	return nil
+}
+
+// replay calls the functions in fs, in order. If one fails, replay
+// reverses the changes already made by calling the corresponding
+// functions in inv, in reverse order, and returns the error.
+func (u *UI) replay(fs, inv []func() error) error {
+	u.hist.replaying = true
+	err := u.atomically(func() error {
+		for i, f := range fs {
+			if err := f(); err != nil {
+				for j := i - 1; j >= 0; j-- {
+					inv[j]()
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	u.hist.replaying = false
+	u.h.SetGraph(u.Objects())
+	return err
+}
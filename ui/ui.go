@@ -20,15 +20,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
-	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nf/sigourney/audio"
-	"github.com/nf/sigourney/midi"
+	_ "github.com/nf/sigourney/midi" // Registers the gate and note kinds.
+	"github.com/nf/sigourney/wav"
 )
 
 type Handler interface {
-	Hello(kindInputs map[string][]string)
+	Hello(kinds map[string]*Kind)
 	SetGraph(graph []*Object)
 }
 
@@ -37,16 +42,29 @@ type UI struct {
 
 	objects map[string]*Object
 	engine  *audio.Engine
+
+	batch []func() // Pending graph mutations; see atomically.
+	hist  history
+	loads int // Number of loads, each of which clears every history.
 }
 
-func New(h Handler) *UI {
+func New(h Handler, opts ...audio.Option) *UI {
 	u := &UI{h: h, objects: make(map[string]*Object)}
+	u.engine = audio.NewEngine(opts...)
 	u.NewObject("engine", "engine", 0)
-	u.engine = u.objects["engine"].proc.(*audio.Engine)
-	h.Hello(kindInputs())
+	u.objects["engine"].proc = u.engine
+	u.objects["engine"].inputs = u.engine.Inputs()
+	u.hist = history{} // The engine can't be undone.
+	ks := kinds()
+	ks["engine"] = newKind(u.engine.Inputs(), nil, u.engine.KindInfo())
+	h.Hello(ks)
 	return u
 }
 
+func (u *UI) SetBackend(b audio.Backend) {
+	u.engine.SetBackend(b)
+}
+
 func (u *UI) Start() error {
 	return u.engine.Start()
 }
@@ -55,26 +73,73 @@ func (u *UI) Stop() error {
 	return u.engine.Stop()
 }
 
+func (u *UI) SampleRate() int {
+	return u.engine.SampleRate()
+}
+
+func (u *UI) FrameLength() int {
+	return u.engine.FrameLength()
+}
+
+func (u *UI) Channels() int {
+	return u.engine.Channels()
+}
+
 func (u *UI) Render(frames int) []audio.Sample {
 	return u.engine.Render(frames)
 }
 
+func (u *UI) Record(name string, f wav.Format) (*audio.Recorder, error) {
+	return u.engine.Record(name, f)
+}
+
 func (u *UI) Destroy(name string) error {
+	return u.atomically(func() error { return u.destroy(name) })
+}
+
+func (u *UI) destroy(name string) error {
 	o, ok := u.objects[name]
 	if !ok {
 		return errors.New("bad Name: " + name)
 	}
 	if o.dup != nil {
-		u.engine.Lock()
-		u.engine.RemoveTicker(o.dup)
-		u.engine.Unlock()
+		u.do(func() { u.engine.RemoveTicker(o.dup) })
 	}
 	for d := range o.output {
-		u.Disconnect(name, d.name, d.input)
+		u.disconnect(name, d.name, d.input)
 	}
 	for input, from := range o.Input {
-		u.Disconnect(from, name, input)
+		u.disconnect(from, name, input)
 	}
+	kind, value, seed, file, steps, maxDelay := o.Kind, o.Value, o.Seed, o.File, o.Steps, o.MaxDelay
+	display := copyDisplay(o.Display)
+	u.record(func() error { return u.destroy(name) }, func() error {
+		if err := u.newObject(name, kind, value); err != nil {
+			return err
+		}
+		if seed != 0 {
+			if err := u.setSeed(name, seed); err != nil {
+				return err
+			}
+		}
+		if file != "" {
+			if err := u.setFile(name, file); err != nil {
+				return err
+			}
+		}
+		if steps != 0 {
+			if err := u.setSteps(name, steps); err != nil {
+				return err
+			}
+		}
+		if maxDelay != 0 {
+			if err := u.setMaxDelay(name, maxDelay); err != nil {
+				return err
+			}
+		}
+		u.objects[name].Display = copyDisplay(display)
+		return nil
+	})
 	delete(u.objects, name)
 	return nil
 }
@@ -87,46 +152,132 @@ func (u *UI) Save(path string) error {
 	return ioutil.WriteFile(path, b, 0644)
 }
 
-func (u *UI) Load(path string) error {
-	for name := range u.objects {
-		if name != "engine" {
-			if err := u.Destroy(name); err != nil {
-				return err
-			}
-		}
-	}
-	f, err := os.Open(path)
+// Load replaces the UI's objects with those of the patch at path.
+// The new graph is swapped into the engine without interrupting it,
+// fading from the old graph over the given duration.
+// Load clears the undo history.
+func (u *UI) Load(path string, fade time.Duration) error {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("load: %v", err)
 	}
-	defer f.Close()
 	objs := make(map[string]*Object)
-	if err := json.NewDecoder(f).Decode(&objs); err != nil {
+	if err := json.Unmarshal(b, &objs); err != nil {
+		return fmt.Errorf("load: %v", err)
+	}
+	var list []*Object
+	for _, o := range objs {
+		list = append(list, o)
+	}
+	return u.LoadObjects(list, fade)
+}
+
+// LoadObjects is like Load, but takes the objects of the patch
+// rather than the name of a file.
+func (u *UI) LoadObjects(objs []*Object, fade time.Duration) error {
+	err := u.atomically(func() error { return u.load(objs, fade) })
+	u.loads++
+	u.hist = history{loads: u.loads}
+	return err
+}
+
+func (u *UI) load(objs []*Object, fade time.Duration) error {
+	if u.engine.Channels() > 1 {
+		// Patches saved with a mono engine drive its first channel.
+		for _, o := range objs {
+			if from, ok := o.Input["in"]; ok && o.Kind == "engine" {
+				delete(o.Input, "in")
+				o.Input["in0"] = from
+			}
+		}
+	}
+	// Check the whole patch first, so that a bad one leaves the
+	// running patch as it is.
+	if err := u.checkPatch(objs); err != nil {
 		return fmt.Errorf("load: %v", err)
 	}
+	// Read the sounds first, so that a missing one leaves the patch as it is.
+	sounds := make(map[string]*audio.Sound)
 	for _, o := range objs {
-		if o.Kind != "engine" {
-			u.NewObject(o.Name, o.Kind, float64(o.Value))
+		if o.File != "" {
+			p, _ := audio.NewKind(o.Kind)
+			if _, ok := p.(audio.Player); !ok {
+				return fmt.Errorf("load: file %v: %v does not play files", o.Name, o.Kind)
+			}
+			snd, err := audio.LoadSound(o.File)
+			if err != nil {
+				return fmt.Errorf("load: file %v: %v", o.Name, err)
+			}
+			sounds[o.Name] = snd
+		}
+	}
+	var tickers int
+	for _, o := range u.objects {
+		if o.dup != nil {
+			tickers++
+		}
+	}
+	u.do(u.engine.Crossfade(fade, tickers))
+	// Detach the old objects from the engine, but leave their own
+	// connections alone so that they play on during the crossfade.
+	for input, from := range u.objects["engine"].Input {
+		if err := u.disconnect(from, "engine", input); err != nil {
+			return err
+		}
+	}
+	for name, o := range u.objects {
+		if name == "engine" {
+			continue
+		}
+		if d := o.dup; d != nil {
+			u.do(func() { u.engine.RemoveTicker(d) })
+		}
+		delete(u.objects, name)
+	}
+	for _, o := range objs {
+		if o.Kind == "engine" {
+			// Kept from the old patch.
+		} else if err := u.newObject(o.Name, o.Kind, float64(o.Value)); err != nil {
+			return fmt.Errorf("load: %v", err)
+		} else if o.Seed != 0 {
+			if err := u.setSeed(o.Name, o.Seed); err != nil {
+				return fmt.Errorf("load: %v", err)
+			}
+		}
+		if o.File != "" {
+			obj := u.objects[o.Name]
+			u.setSound(obj, obj.proc.(audio.Player), o.File, sounds[o.Name])
+		}
+		if o.Steps != 0 {
+			if err := u.setSteps(o.Name, o.Steps); err != nil {
+				return fmt.Errorf("load: %v", err)
+			}
+		}
+		if o.MaxDelay != 0 {
+			if err := u.setMaxDelay(o.Name, o.MaxDelay); err != nil {
+				return fmt.Errorf("load: %v", err)
+			}
 		}
 		u.objects[o.Name].Display = o.Display
 	}
-	for to, o := range objs {
+	for _, o := range objs {
 		for input, from := range o.Input {
-			if err := u.Connect(from, to, input); err != nil {
+			if err := u.connect(from, o.Name, input); err != nil {
 				return err
 			}
 		}
 	}
-	var graph []*Object
-	for _, o := range objs {
-		graph = append(graph, o)
-	}
-	u.h.SetGraph(graph)
+	u.h.SetGraph(u.Objects())
 	return nil
 }
 
 func (u *UI) Disconnect(from, to, input string) error {
-	f, ok := u.objects[from]
+	return u.atomically(func() error { return u.disconnect(from, to, input) })
+}
+
+func (u *UI) disconnect(from, to, input string) error {
+	name, _ := SplitOutput(from)
+	f, ok := u.objects[name]
 	if !ok {
 		return errors.New("unknown From: " + from)
 	}
@@ -135,11 +286,13 @@ func (u *UI) Disconnect(from, to, input string) error {
 		return errors.New("unknown To: " + to)
 	}
 
-	u.engine.Lock()
-	f.output[dest{to, input}].Close()
-	t.proc.(audio.Sink).Input(input, audio.Value(0))
-	u.engine.Unlock()
+	s := t.proc.(audio.Sink)
+	u.do(func() { s.Input(input, audio.Value(0)) })
 
+	if old, ok := t.Input[input]; ok {
+		u.record(func() error { return u.disconnect(old, to, input) },
+			func() error { return u.connect(old, to, input) })
+	}
 	delete(f.output, dest{to, input})
 	delete(t.Input, input)
 
@@ -147,45 +300,255 @@ func (u *UI) Disconnect(from, to, input string) error {
 }
 
 func (u *UI) Connect(from, to, input string) error {
-	f, ok := u.objects[from]
-	if !ok {
+	return u.atomically(func() error { return u.connect(from, to, input) })
+}
+
+func (u *UI) connect(from, to, input string) error {
+	name, output := SplitOutput(from)
+	f, ok := u.objects[name]
+	if !ok || f.dup == nil {
 		return errors.New("unknown From: " + from)
 	}
+	n, ok := f.outputIndex(output)
+	if !ok {
+		return errors.New("unknown output: " + from)
+	}
 	t, ok := u.objects[to]
 	if !ok {
 		return errors.New("unknown To: " + to)
 	}
+	if !t.hasInput(input) {
+		return fmt.Errorf("%v has no input %v", to, input)
+	}
+	if v, ok := f.proc.(audio.Value); ok {
+		if err := u.checkInput(dest{to, input}, float64(v)); err != nil {
+			return fmt.Errorf("connect %v: %v", from, err)
+		}
+	}
+	if old, ok := t.Input[input]; ok {
+		if old == from {
+			return nil
+		}
+		if err := u.disconnect(old, to, input); err != nil {
+			return err
+		}
+	}
 
-	u.engine.Lock()
-	o := f.dup.Output()
-	t.proc.(audio.Sink).Input(input, o)
-	u.engine.Unlock()
+	o, s := f.dup.OutputN(n), t.proc.(audio.Sink)
+	u.do(func() { s.Input(input, o) })
 
 	f.output[dest{to, input}] = o
 	t.Input[input] = from
+	u.record(func() error { return u.connect(from, to, input) },
+		func() error { return u.disconnect(from, to, input) })
 
 	return nil
 }
 
 func (u *UI) Set(name string, v float64) error {
+	return u.atomically(func() error { return u.set(name, v) })
+}
+
+func (u *UI) set(name string, v float64) error {
 	o, ok := u.objects[name]
 	if !ok {
 		return errors.New("unknown object: " + name)
 	}
+	for d := range o.output {
+		if err := u.checkInput(d, v); err != nil {
+			return fmt.Errorf("set %v: %v", name, err)
+		}
+	}
+	u.setValue(o, v)
+	return nil
+}
+
+func (u *UI) setValue(o *Object, v float64) {
+	name, old := o.Name, o.Value
+	u.record(func() error { return u.setValueOf(name, v) },
+		func() error { return u.setValueOf(name, old) })
 	o.Value = v
 	av := audio.Value(v)
 	o.proc = av
-	u.engine.Lock()
-	o.dup.SetSource(av)
-	u.engine.Unlock()
+	d := o.dup
+	u.do(func() { d.SetSource(av) })
+}
+
+// setValueOf sets the value of the named object without validating it.
+func (u *UI) setValueOf(name string, v float64) error {
+	o, ok := u.objects[name]
+	if !ok {
+		return errors.New("unknown object: " + name)
+	}
+	u.setValue(o, v)
+	return nil
+}
+
+// SetSeed restarts the random source of the named object with the given
+// seed. The object's kind must implement audio.Seeder.
+// A seed of 0 restores the object's default seed; see DefaultSeed.
+func (u *UI) SetSeed(name string, seed int64) error {
+	return u.atomically(func() error { return u.setSeed(name, seed) })
+}
+
+func (u *UI) setSeed(name string, seed int64) error {
+	o, ok := u.objects[name]
+	if !ok {
+		return errors.New("unknown object: " + name)
+	}
+	sd, ok := o.proc.(audio.Seeder)
+	if !ok {
+		return fmt.Errorf("seed %v: %v is not random", name, o.Kind)
+	}
+	if seed == 0 {
+		// Patches store no seed for objects with the default.
+		seed = DefaultSeed(name)
+	}
+	old := o.Seed
+	u.record(func() error { return u.setSeed(name, seed) },
+		func() error { return u.setSeed(name, old) })
+	o.Seed = seed
+	u.do(func() { sd.Seed(seed) })
+	return nil
+}
+
+// SetFile loads the named WAV file from audio.SampleDir into the named
+// object, whose kind must implement audio.Player. An empty file name
+// leaves the object silent.
+func (u *UI) SetFile(name, file string) error {
+	return u.atomically(func() error { return u.setFile(name, file) })
+}
+
+func (u *UI) setFile(name, file string) error {
+	o, ok := u.objects[name]
+	if !ok {
+		return errors.New("unknown object: " + name)
+	}
+	p, ok := o.proc.(audio.Player)
+	if !ok {
+		return fmt.Errorf("file %v: %v does not play files", name, o.Kind)
+	}
+	var snd *audio.Sound
+	if file != "" {
+		var err error
+		if snd, err = audio.LoadSound(file); err != nil {
+			return fmt.Errorf("file %v: %v", name, err)
+		}
+	}
+	u.setSound(o, p, file, snd)
+	return nil
+}
+
+// setSound makes p, the proc of o, play snd, which was loaded from file.
+func (u *UI) setSound(o *Object, p audio.Player, file string, snd *audio.Sound) {
+	name, old := o.Name, o.File
+	u.record(func() error { return u.setFile(name, file) },
+		func() error { return u.setFile(name, old) })
+	o.File = file
+	u.do(func() { p.SetSound(snd) })
+}
+
+// SetSteps sets the number of steps of the named object, whose kind must
+// implement audio.Stepper. The inputs of removed steps are disconnected.
+func (u *UI) SetSteps(name string, n int) error {
+	return u.atomically(func() error { return u.setSteps(name, n) })
+}
+
+func (u *UI) setSteps(name string, n int) error {
+	o, ok := u.objects[name]
+	if !ok {
+		return errors.New("unknown object: " + name)
+	}
+	st, ok := o.proc.(audio.Stepper)
+	if !ok {
+		return fmt.Errorf("steps %v: %v has no steps", name, o.Kind)
+	}
+	if n < 1 || n > audio.MaxSteps {
+		return fmt.Errorf("steps %v: %v is not between 1 and %v", name, n, audio.MaxSteps)
+	}
+	// Find the new inputs on a spare module,
+	// as st belongs to the audio thread.
+	p, err := audio.NewKind(o.Kind)
+	if err != nil {
+		return err
+	}
+	p.(audio.Stepper).SetSteps(n)
+	inputs := p.(audio.Sink).Inputs()
+	for input, from := range o.Input {
+		if i := sort.SearchStrings(inputs, input); i == len(inputs) || inputs[i] != input {
+			if err := u.disconnect(from, name, input); err != nil {
+				return err
+			}
+		}
+	}
+	old := o.Steps
+	u.record(func() error { return u.setSteps(name, n) },
+		func() error { return u.setSteps(name, old) })
+	o.Steps, o.inputs = n, inputs
+	u.do(func() { st.SetSteps(n) })
 	return nil
 }
 
+// SetMaxDelay sets the longest delay, in seconds, of the named object,
+// whose kind must implement audio.Delayer.
+func (u *UI) SetMaxDelay(name string, seconds float64) error {
+	return u.atomically(func() error { return u.setMaxDelay(name, seconds) })
+}
+
+func (u *UI) setMaxDelay(name string, seconds float64) error {
+	o, ok := u.objects[name]
+	if !ok {
+		return errors.New("unknown object: " + name)
+	}
+	d, ok := o.proc.(audio.Delayer)
+	if !ok {
+		return fmt.Errorf("max delay %v: %v has no delay", name, o.Kind)
+	}
+	if err := checkMaxDelay(seconds); err != nil {
+		return fmt.Errorf("max delay %v: %v", name, err)
+	}
+	old := o.MaxDelay
+	u.record(func() error { return u.setMaxDelay(name, seconds) },
+		func() error { return u.setMaxDelay(name, old) })
+	o.MaxDelay = seconds
+	// The buffer is allocated here, rather than by the audio thread.
+	u.do(d.SetMaxDelay(seconds))
+	return nil
+}
+
+func checkMaxDelay(seconds float64) error {
+	if !(seconds > 0 && seconds <= audio.LongestDelay) {
+		return fmt.Errorf("%v is not more than 0 and at most %v seconds", seconds, audio.LongestDelay)
+	}
+	return nil
+}
+
+// DefaultSeed returns the seed given to the random source of a new object
+// with the given name, so that a patch sounds the same each time it is
+// loaded unless it has been reseeded. Seeds are less than 1<<53, so that
+// they survive the trip through JavaScript.
+func DefaultSeed(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64() >> 11)
+}
+
 func (u *UI) SetDisplay(name string, display map[string]interface{}) error {
+	return u.atomically(func() error { return u.setDisplay(name, display) })
+}
+
+func (u *UI) setDisplay(name string, display map[string]interface{}) error {
 	o, ok := u.objects[name]
 	if !ok {
 		return errors.New("unknown object: " + name)
 	}
+	old := copyDisplay(o.Display)
+	u.record(func() error { return u.setDisplay(name, display) }, func() error {
+		if o, ok := u.objects[name]; ok {
+			o.Display = copyDisplay(old)
+		}
+		return nil
+	})
 	for k, v := range display {
 		if o.Display == nil {
 			o.Display = make(map[string]interface{})
@@ -195,74 +558,230 @@ func (u *UI) SetDisplay(name string, display map[string]interface{}) error {
 	return nil
 }
 
-func (u *UI) NewObject(name, kind string, value float64) {
+func (u *UI) NewObject(name, kind string, value float64) error {
+	return u.atomically(func() error { return u.newObject(name, kind, value) })
+}
+
+func (u *UI) newObject(name, kind string, value float64) error {
+	if _, ok := u.objects[name]; ok {
+		return errors.New("name in use: " + name)
+	}
 	o := &Object{Name: name, Kind: kind, Value: value, Input: make(map[string]string)}
-	o.init()
+	if err := o.init(); err != nil {
+		return err
+	}
+	if c, ok := o.proc.(audio.Configurer); ok && kind != "engine" {
+		c.Configure(u.engine.Config())
+	}
 	if o.dup != nil {
-		u.engine.Lock()
-		u.engine.AddTicker(o.dup)
-		u.engine.Unlock()
+		u.do(func() { u.engine.AddTicker(o.dup) })
 	}
 	u.objects[name] = o
+	u.record(func() error { return u.newObject(name, kind, value) },
+		func() error { return u.destroy(name) })
+	return nil
+}
+
+func copyDisplay(d map[string]interface{}) map[string]interface{} {
+	if d == nil {
+		return nil
+	}
+	c := make(map[string]interface{})
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
+// do adds the given graph mutations to the current batch.
+// It must only be called inside atomically.
+func (u *UI) do(fs ...func()) {
+	u.batch = append(u.batch, fs...)
+}
+
+// atomically calls f and applies all of the graph mutations it makes
+// to the running engine in a single step, along with a new schedule for
+// the engine's workers. The changes f makes are recorded as a single
+// step in the undo history. If f fails, the changes it made are reversed
+// and not recorded. Nested calls are part of the outermost batch.
+func (u *UI) atomically(f func() error) error {
+	if u.batch != nil {
+		return f()
+	}
+	u.batch = []func(){}
+	u.begin()
+	mark := u.hist.mark()
+	err := f()
+	if err != nil {
+		u.rollback(mark)
+	}
+	u.commit()
+	fs := u.batch
+	u.batch = nil
+	if len(fs) == 0 {
+		return err
+	}
+	if u.engine.Workers() > 1 {
+		fs = append(fs, u.engine.Plan(u.graph()))
+	}
+	u.engine.Do(fs...)
+	return err
+}
+
+// Objects returns the UI's objects.
+func (u *UI) Objects() []*Object {
+	var objs []*Object
+	for _, o := range u.objects {
+		objs = append(objs, o)
+	}
+	return objs
+}
+
+// graph describes the dependencies between the objects' Dups.
+func (u *UI) graph() *audio.Graph {
+	g := audio.NewGraph()
+	for _, o := range u.objects {
+		var deps []*audio.Dup
+		for _, from := range o.Input {
+			name, _ := SplitOutput(from)
+			if f := u.objects[name]; f != nil && f.dup != nil {
+				deps = append(deps, f.dup)
+			}
+		}
+		switch {
+		case o.dup != nil:
+			g.Add(o.dup, deps...)
+		case o.proc == u.engine:
+			for _, d := range deps {
+				g.Root(d)
+			}
+		}
+	}
+	return g
 }
 
 type Object struct {
-	Name    string
-	Kind    string
-	Value   float64
-	Input   map[string]string
-	Display map[string]interface{}
+	Name     string
+	Kind     string
+	Value    float64
+	Seed     int64   `json:",omitempty"` // Only for kinds that implement audio.Seeder.
+	File     string  `json:",omitempty"` // Only for kinds that implement audio.Player.
+	Steps    int     `json:",omitempty"` // Only for kinds that implement audio.Stepper.
+	MaxDelay float64 `json:",omitempty"` // Seconds; only for kinds that implement audio.Delayer.
+	Input    map[string]string
+	Display  map[string]interface{}
 
 	proc   interface{}
 	dup    *audio.Dup
 	output map[dest]*audio.Output
+	inputs []string // Sorted names of the inputs of proc.
 }
 
 type dest struct {
 	name, input string
 }
 
-func (o *Object) init() {
+// SplitOutput splits a connection source of the form "object.output"
+// into its object and output names. A bare object name refers to the
+// object's first output, so the output name is empty.
+func SplitOutput(from string) (name, output string) {
+	if i := strings.Index(from, "."); i >= 0 {
+		return from[:i], from[i+1:]
+	}
+	return from, ""
+}
+
+// SortedInputs returns the names of the connected inputs of o, in order.
+func (o *Object) SortedInputs() []string {
+	var a []string
+	for input := range o.Input {
+		a = append(a, input)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// SortNames sorts names such as "sin2" and "sin10" by their
+// numeric suffix, which the user interface assigns in order of creation.
+func SortNames(names []string) {
+	sort.Sort(byNumber(names))
+}
+
+type byNumber []string
+
+func (s byNumber) Len() int      { return len(s) }
+func (s byNumber) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNumber) Less(i, j int) bool {
+	a, na := splitNumber(s[i])
+	b, nb := splitNumber(s[j])
+	if na != nb {
+		return na < nb
+	}
+	return a < b
+}
+
+func splitNumber(name string) (string, int) {
+	i := len(name)
+	for i > 0 && '0' <= name[i-1] && name[i-1] <= '9' {
+		i--
+	}
+	n, _ := strconv.Atoi(name[i:])
+	return name[:i], n
+}
+
+// hasInput reports whether the object has the named input.
+func (o *Object) hasInput(input string) bool {
+	i := sort.SearchStrings(o.inputs, input)
+	return i < len(o.inputs) && o.inputs[i] == input
+}
+
+// outputIndex returns the index of the named output of the object.
+func (o *Object) outputIndex(output string) (int, bool) {
+	if output == "" {
+		return 0, true
+	}
+	if m, ok := o.proc.(audio.MultiProcessor); ok {
+		for i, name := range m.Outputs() {
+			if name == output {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (o *Object) init() error {
 	var p interface{}
-	switch o.Kind {
-	case "clip":
-		p = audio.NewClip()
-	case "delay":
-		p = audio.NewDelay()
-	case "engine":
+	if o.Kind == "engine" {
 		p = audio.NewEngine()
-	case "env":
-		p = audio.NewEnv()
-	case "mul":
-		p = audio.NewMul()
-	case "noise":
-		p = audio.NewNoise()
-	case "quant":
-		p = audio.NewQuant()
-	case "rand":
-		p = audio.NewRand()
-	case "saw":
-		p = audio.NewBandLimitedSaw()
-	case "sin":
-		p = audio.NewSin()
-	case "skip":
-		p = audio.NewSkip()
-	case "sequencer":
-		p = audio.NewStep()
-	case "square":
-		p = audio.NewBandLimitedSquare()
-	case "sum":
-		p = audio.NewSum()
-	case "triangle":
-		p = audio.NewBandLimitedTriangle()
-	case "value":
-		p = audio.Value(o.Value)
-	case "gate":
-		p = midi.NewGate()
-	case "note":
-		p = midi.NewNote()
-	default:
-		panic("bad kind: " + o.Kind)
+	} else {
+		proc, err := audio.NewKind(o.Kind)
+		if err != nil {
+			return err
+		}
+		if _, ok := proc.(audio.Value); ok {
+			proc = audio.Value(o.Value)
+		}
+		if sd, ok := proc.(audio.Seeder); ok {
+			if o.Seed == 0 {
+				o.Seed = DefaultSeed(o.Name)
+			}
+			sd.Seed(o.Seed)
+		}
+		if st, ok := proc.(audio.Stepper); ok {
+			if o.Steps == 0 {
+				o.Steps = audio.DefaultSteps
+			}
+			st.SetSteps(o.Steps)
+		}
+		if d, ok := proc.(audio.Delayer); ok {
+			if o.MaxDelay == 0 {
+				o.MaxDelay = audio.DefaultMaxDelay
+			} else {
+				d.SetMaxDelay(o.MaxDelay)()
+			}
+		}
+		p = proc
 	}
 	var dup *audio.Dup
 	if proc, ok := p.(audio.Processor); ok {
@@ -271,41 +790,154 @@ func (o *Object) init() {
 	o.proc = p
 	o.dup = dup
 	o.output = make(map[dest]*audio.Output)
+	if s, ok := p.(audio.Sink); ok {
+		o.inputs = s.Inputs()
+	}
+	return nil
+}
+
+// checkInput reports whether v is a valid value for the given input.
+func (u *UI) checkInput(d dest, v float64) error {
+	t, ok := u.objects[d.name]
+	if !ok {
+		return nil
+	}
+	return u.checkKindInput(t.Kind, d, v)
+}
+
+// checkKindInput reports whether v is a valid value for the given input
+// of an object of the given kind.
+func (u *UI) checkKindInput(kind string, d dest, v float64) error {
+	var info audio.KindInfo
+	if kind == "engine" {
+		info = u.engine.KindInfo()
+	} else if i, ok := audio.LookupKind(kind); ok {
+		info = i
+	} else {
+		return nil
+	}
+	if in, ok := info.Input(d.input); ok {
+		if err := in.Check(v); err != nil {
+			return fmt.Errorf("%v.%v: %v", d.name, d.input, err)
+		}
+	}
+	return nil
+}
+
+// checkPatch reports whether objs form a patch that load can make
+// without error: each object has a unique name and a known kind, each
+// connection is from an output of one of objs to an input of another,
+// and the values in objs are valid for the inputs they are connected to.
+func (u *UI) checkPatch(objs []*Object) error {
+	byName := make(map[string]*Object)
+	spare := make(map[string]*Object) // Unplayed copies of objs.
+	for _, o := range objs {
+		if _, ok := byName[o.Name]; ok {
+			return errors.New("name in use: " + o.Name)
+		}
+		if (o.Name == "engine") != (o.Kind == "engine") {
+			return errors.New("bad engine: " + o.Name)
+		}
+		byName[o.Name] = o
+		if o.Kind == "engine" {
+			spare[o.Name] = &Object{Name: o.Name, Kind: o.Kind, proc: u.engine, inputs: u.engine.Inputs()}
+			continue
+		}
+		if o.Steps < 0 || o.Steps > audio.MaxSteps {
+			return fmt.Errorf("steps %v: %v is not between 1 and %v", o.Name, o.Steps, audio.MaxSteps)
+		}
+		// The spare has the default maximum delay, to save
+		// allocating the buffer of a long one.
+		s := &Object{Name: o.Name, Kind: o.Kind, Value: o.Value, Steps: o.Steps}
+		if err := s.init(); err != nil {
+			return err
+		}
+		if _, ok := s.proc.(audio.Seeder); !ok && o.Seed != 0 {
+			return fmt.Errorf("seed %v: %v is not random", o.Name, o.Kind)
+		}
+		if _, ok := s.proc.(audio.Stepper); !ok && o.Steps != 0 {
+			return fmt.Errorf("steps %v: %v has no steps", o.Name, o.Kind)
+		}
+		if _, ok := s.proc.(audio.Delayer); o.MaxDelay != 0 {
+			if !ok {
+				return fmt.Errorf("max delay %v: %v has no delay", o.Name, o.Kind)
+			}
+			if err := checkMaxDelay(o.MaxDelay); err != nil {
+				return fmt.Errorf("max delay %v: %v", o.Name, err)
+			}
+		}
+		spare[o.Name] = s
+	}
+	for _, o := range objs {
+		for input, from := range o.Input {
+			name, output := SplitOutput(from)
+			f, ok := spare[name]
+			if !ok || f.dup == nil {
+				return fmt.Errorf("%v.%v: unknown From: %v", o.Name, input, from)
+			}
+			if _, ok := f.outputIndex(output); !ok {
+				return fmt.Errorf("%v.%v: unknown output: %v", o.Name, input, from)
+			}
+			if !spare[o.Name].hasInput(input) {
+				return fmt.Errorf("%v has no input %v", o.Name, input)
+			}
+			if f.Kind != "value" {
+				continue
+			}
+			if err := u.checkKindInput(o.Kind, dest{o.Name, input}, byName[name].Value); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// A Kind describes a kind of object to the user interface.
+type Kind struct {
+	Inputs    []string
+	InputInfo map[string]audio.InputInfo `json:",omitempty"`
+	Outputs   []string                   `json:",omitempty"` // Only for kinds with more than one.
+	Doc       string                     `json:",omitempty"`
+	Random    bool                       `json:",omitempty"` // Whether it may be seeded.
+	File      bool                       `json:",omitempty"` // Whether it plays a file.
+	Steps     bool                       `json:",omitempty"` // Whether its number of steps may be set.
+	Delay     bool                       `json:",omitempty"` // Whether its maximum delay may be set.
+}
+
+func newKind(inputs, outputs []string, info audio.KindInfo) *Kind {
+	k := &Kind{Inputs: inputs, Outputs: outputs, Doc: info.Doc}
+	for _, name := range inputs {
+		if in, ok := info.Input(name); ok {
+			if k.InputInfo == nil {
+				k.InputInfo = make(map[string]audio.InputInfo)
+			}
+			k.InputInfo[name] = in
+		}
+	}
+	return k
 }
 
-func kindInputs() map[string][]string {
-	m := make(map[string][]string)
-	for _, k := range kinds {
+// kinds describes each registered kind.
+func kinds() map[string]*Kind {
+	m := make(map[string]*Kind)
+	for _, k := range audio.Kinds() {
 		o := &Object{Name: "unnamed", Kind: k}
-		o.init()
-		var in []string
+		if err := o.init(); err != nil {
+			panic(err)
+		}
+		var inputs, outputs []string
 		if s, ok := o.proc.(audio.Sink); ok {
-			in = s.Inputs()
+			inputs = s.Inputs()
+		}
+		if p, ok := o.proc.(audio.MultiProcessor); ok {
+			outputs = p.Outputs()
 		}
-		m[k] = in
+		info, _ := audio.LookupKind(k)
+		m[k] = newKind(inputs, outputs, info)
+		_, m[k].Random = o.proc.(audio.Seeder)
+		_, m[k].File = o.proc.(audio.Player)
+		_, m[k].Steps = o.proc.(audio.Stepper)
+		_, m[k].Delay = o.proc.(audio.Delayer)
 	}
 	return m
 }
-
-var kinds = []string{
-	"clip",
-	"delay",
-	"engine",
-	"env",
-	"mul",
-	"noise",
-	"quant",
-	"rand",
-	"saw",
-	"sequencer",
-	"square",
-	"sin",
-	"skip",
-	"square",
-	"sum",
-	"triangle",
-	"value",
-
-	"gate",
-	"note",
-}
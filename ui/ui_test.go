@@ -0,0 +1,597 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nf/sigourney/audio"
+	"github.com/nf/sigourney/wav"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) Hello(map[string]*Kind) {}
+func (nopHandler) SetGraph([]*Object)     {}
+
+func snapshot(t *testing.T, u *UI) string {
+	b, err := json.Marshal(u.objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUndo(t *testing.T) {
+	u := New(nopHandler{})
+	if err := u.Undo(); err == nil {
+		t.Error("Undo of new UI succeeded")
+	}
+
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var states []string
+	do := func(f func()) {
+		states = append(states, snapshot(t, u))
+		f()
+	}
+	do(func() { check(u.NewObject("sin1", "sin", 0)) })
+	do(func() { check(u.NewObject("value2", "value", 0.1)) })
+	do(func() { check(u.SetDisplay("sin1", map[string]interface{}{"label": "osc"})) })
+	do(func() { check(u.Connect("value2", "sin1", "pitch")) })
+	do(func() { check(u.Connect("sin1", "engine", "in")) })
+	do(func() { check(u.Set("value2", -0.2)) })
+	do(func() {
+		// Delete two objects as a single step.
+		u.BeginGroup()
+		check(u.Destroy("sin1"))
+		check(u.Destroy("value2"))
+		check(u.EndGroup())
+	})
+	final := snapshot(t, u)
+
+	for i := len(states) - 1; i >= 0; i-- {
+		check(u.Undo())
+		if got := snapshot(t, u); got != states[i] {
+			t.Fatalf("after undo %d:\ngot  %v\nwant %v", len(states)-i, got, states[i])
+		}
+	}
+	if err := u.Undo(); err == nil {
+		t.Error("Undo past the first step succeeded")
+	}
+	for i := 1; i < len(states); i++ {
+		check(u.Redo())
+		if got := snapshot(t, u); got != states[i] {
+			t.Fatalf("after redo %d:\ngot  %v\nwant %v", i, got, states[i])
+		}
+	}
+	check(u.Redo())
+	if got := snapshot(t, u); got != final {
+		t.Fatalf("after last redo:\ngot  %v\nwant %v", got, final)
+	}
+
+	// A new change discards the steps that could be redone.
+	check(u.Undo())
+	check(u.NewObject("sin3", "sin", 0))
+	if err := u.Redo(); err == nil {
+		t.Error("Redo after a new change succeeded")
+	}
+}
+
+func TestLoadCrossfade(t *testing.T) {
+	const rate = 1024
+	u := New(nopHandler{}, audio.SampleRate(rate), audio.Lookahead(0))
+	a := []*Object{
+		{Name: "engine", Kind: "engine", Input: map[string]string{"in": "mul1"}},
+		{Name: "mul1", Kind: "mul", Input: map[string]string{"a": "value2", "b": "value3"}},
+		{Name: "value2", Kind: "value", Value: 0.5},
+		{Name: "value3", Kind: "value", Value: 0.5},
+	}
+	if err := u.LoadObjects(a, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range u.Render(1) {
+		if v != 0.25 {
+			t.Fatalf("before fade: sample %v == %v, want 0.25", i, v)
+		}
+	}
+
+	// Fade to silence over one second.
+	b := []*Object{{Name: "engine", Kind: "engine"}}
+	if err := u.LoadObjects(b, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	out := u.Render(rate/audio.FrameLength + 1)
+	for i, v := range out {
+		want := 0.0
+		if i < rate {
+			want = 0.25 * (1 - float64(i)/rate)
+		}
+		if math.Abs(float64(v)-want) > 1e-6 {
+			t.Fatalf("during fade: sample %v == %v, want %v", i, v, want)
+		}
+	}
+}
+
+func TestLoadBadPatch(t *testing.T) {
+	u := New(nopHandler{}, audio.Lookahead(0))
+	good := []*Object{
+		{Name: "engine", Kind: "engine", Input: map[string]string{"in": "value1"}},
+		{Name: "value1", Kind: "value", Value: 0.5},
+	}
+	if err := u.LoadObjects(good, 0); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshot(t, u)
+	for _, objs := range [][]*Object{
+		{{Name: "engine", Kind: "engine"}, {Name: "foo1", Kind: "foo"}},
+		{{Name: "engine", Kind: "engine", Input: map[string]string{"in": "sin1"}}},
+		{{Name: "engine", Kind: "engine", Input: map[string]string{"in": "sin1.foo"}}, {Name: "sin1", Kind: "sin"}},
+		{{Name: "engine", Kind: "engine", Input: map[string]string{"in0": "sin1"}}, {Name: "sin1", Kind: "sin"}},
+		{{Name: "engine", Kind: "engine"}, {Name: "sin1", Kind: "sin", Input: map[string]string{"foo": "value2"}}, {Name: "value2", Kind: "value"}},
+		{{Name: "engine", Kind: "engine"}, {Name: "sin1", Kind: "sin", Seed: 1}},
+		{{Name: "engine", Kind: "engine"}, {Name: "sequencer1", Kind: "sequencer", Steps: audio.MaxSteps + 1}},
+		{{Name: "engine", Kind: "engine"}, {Name: "sin1", Kind: "sin"}, {Name: "sin1", Kind: "sin"}},
+		{{Name: "engine", Kind: "sin"}},
+	} {
+		if err := u.LoadObjects(objs, 0); err == nil {
+			t.Errorf("Load of bad patch %v succeeded", objs)
+			continue
+		}
+		if got := snapshot(t, u); got != before {
+			t.Fatalf("failed Load changed the patch:\ngot  %v\nwant %v", got, before)
+		}
+		for i, v := range u.Render(1) {
+			if v != 0.5 {
+				t.Fatalf("after failed Load: sample %v == %v, want 0.5", i, v)
+			}
+		}
+	}
+}
+
+func TestAtomicallyFailure(t *testing.T) {
+	u := New(nopHandler{}, audio.Lookahead(0))
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(u.NewObject("value1", "value", 0.5))
+	check(u.Connect("value1", "engine", "in"))
+	before := snapshot(t, u)
+
+	// A failed change is reversed, in the UI and in the engine,
+	// and leaves nothing to undo.
+	failed := errors.New("failed")
+	err := u.atomically(func() error {
+		check(u.newObject("value2", "value", 0.25))
+		check(u.connect("value2", "engine", "in"))
+		check(u.set("value1", 0.75))
+		return failed
+	})
+	if err != failed {
+		t.Errorf("atomically returned %v, want %v", err, failed)
+	}
+	if got := snapshot(t, u); got != before {
+		t.Errorf("failed change altered the patch:\ngot  %v\nwant %v", got, before)
+	}
+	for i, v := range u.Render(1) {
+		if v != 0.5 {
+			t.Fatalf("after failed change: sample %v == %v, want 0.5", i, v)
+		}
+	}
+	check(u.Undo())
+	if in := u.objects["engine"].Input["in"]; in != "" {
+		t.Errorf("Undo after failed change left engine connected to %q", in)
+	}
+
+	// Inside a group, only the failed change is reversed.
+	u.BeginGroup()
+	check(u.Connect("value1", "engine", "in"))
+	if err := u.atomically(func() error {
+		check(u.newObject("value2", "value", 0.25))
+		return failed
+	}); err != failed {
+		t.Errorf("atomically returned %v, want %v", err, failed)
+	}
+	check(u.EndGroup())
+	if got := snapshot(t, u); got != before {
+		t.Errorf("group with failed change:\ngot  %v\nwant %v", got, before)
+	}
+	check(u.Undo())
+	if in := u.objects["engine"].Input["in"]; in != "" {
+		t.Errorf("Undo of group left engine connected to %q", in)
+	}
+}
+
+func TestUndoFailure(t *testing.T) {
+	u := New(nopHandler{})
+	if err := u.NewObject("sin1", "sin", 0); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshot(t, u)
+
+	// A step whose second change can't be redone.
+	fail := errors.New("fail")
+	s := &step{
+		redo: []func() error{
+			func() error { return u.newObject("sin2", "sin", 0) },
+			func() error { return fail },
+		},
+		undo: []func() error{
+			func() error { return u.destroy("sin2") },
+			func() error { return nil },
+		},
+	}
+	u.hist.undone = append(u.hist.undone, s)
+	if err := u.Redo(); err != fail {
+		t.Fatalf("Redo returned %v, want %v", err, fail)
+	}
+	if got := snapshot(t, u); got != before {
+		t.Errorf("failed Redo changed the patch:\ngot  %v\nwant %v", got, before)
+	}
+	if n := len(u.hist.undone); n != 0 {
+		t.Errorf("after failed Redo, %d steps to redo, want 0", n)
+	}
+	if err := u.Undo(); err != nil {
+		t.Errorf("Undo after failed Redo: %v", err)
+	}
+}
+
+func TestInputRange(t *testing.T) {
+	u := New(nopHandler{})
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(u.NewObject("sin1", "sin", 0))
+	check(u.NewObject("value2", "value", 2))
+	if err := u.Connect("value2", "sin1", "pitch"); err == nil {
+		t.Error("Connect of out of range value succeeded")
+	}
+	check(u.Set("value2", 0.5))
+	check(u.Connect("value2", "sin1", "pitch"))
+	if err := u.Set("value2", 2); err == nil {
+		t.Error("Set of out of range value succeeded")
+	}
+
+	// A patch with an out of range value is rejected before
+	// anything is changed.
+	before := snapshot(t, u)
+	objs := []*Object{
+		{Name: "sin1", Kind: "sin", Input: map[string]string{"pitch": "value2"}},
+		{Name: "value2", Kind: "value", Value: -3},
+	}
+	if err := u.LoadObjects(objs, 0); err == nil {
+		t.Error("Load of out of range value succeeded")
+	}
+	if got := snapshot(t, u); got != before {
+		t.Errorf("failed Load changed the patch:\ngot  %v\nwant %v", got, before)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	play := func(seed int64, opts ...audio.Option) []audio.Sample {
+		u := New(nopHandler{}, opts...)
+		check(u.NewObject("noise1", "noise", 0))
+		check(u.NewObject("noise2", "noise", 0))
+		check(u.NewObject("sum3", "sum", 0))
+		check(u.Connect("noise1", "sum3", "a"))
+		check(u.Connect("noise2", "sum3", "b"))
+		check(u.Connect("sum3", "engine", "in"))
+		if seed != 0 {
+			check(u.SetSeed("noise2", seed))
+		}
+		return u.Render(4)
+	}
+	same := func(a, b []audio.Sample) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return len(a) == len(b)
+	}
+
+	// Objects are seeded by name, so a patch sounds the same each time,
+	// however many workers process it.
+	a := play(0)
+	if !same(a, play(0, audio.Workers(3))) {
+		t.Error("patch sounds different with three workers")
+	}
+	if b := play(42); same(a, b) {
+		t.Error("reseeding didn't change the sound")
+	} else if !same(b, play(42)) {
+		t.Error("patch with the same seed sounds different")
+	}
+
+	// Seeds are restored by undo.
+	u := New(nopHandler{})
+	check(u.NewObject("rand1", "rand", 0))
+	def := u.objects["rand1"].Seed
+	if def != DefaultSeed("rand1") {
+		t.Errorf("new object's seed is %v, want %v", def, DefaultSeed("rand1"))
+	}
+	check(u.SetSeed("rand1", 7))
+	check(u.Destroy("rand1"))
+	check(u.Undo())
+	if s := u.objects["rand1"].Seed; s != 7 {
+		t.Errorf("seed after undoing destroy is %v, want 7", s)
+	}
+	check(u.Undo())
+	if s := u.objects["rand1"].Seed; s != def {
+		t.Errorf("seed after undoing SetSeed is %v, want %v", s, def)
+	}
+	check(u.SetSeed("rand1", 7))
+	check(u.SetSeed("rand1", 0))
+	if s := u.objects["rand1"].Seed; s != def {
+		t.Errorf("seed after SetSeed 0 is %v, want %v", s, def)
+	}
+	check(u.NewObject("sin2", "sin", 0))
+	if err := u.SetSeed("sin2", 1); err == nil {
+		t.Error("SetSeed of sin succeeded")
+	}
+}
+
+func silent(s []audio.Sample) bool {
+	for _, v := range s {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFile(t *testing.T) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "sigourney")
+	check(err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { audio.SampleDir = d }(audio.SampleDir)
+	audio.SampleDir = dir
+
+	f, err := os.Create(filepath.Join(dir, "hit.wav"))
+	check(err)
+	enc, err := wav.NewEncoder(f, wav.PCM16, 44100, 1)
+	check(err)
+	hit := make([]float64, 1000)
+	for i := range hit {
+		hit[i] = 0.5
+	}
+	check(enc.Write(hit))
+	check(enc.Close())
+	f.Close()
+
+	u := New(nopHandler{})
+	check(u.NewObject("sampler1", "sampler", 0))
+	check(u.Connect("sampler1", "engine", "in"))
+	check(u.NewObject("value2", "value", 1))
+	check(u.Connect("value2", "sampler1", "trig"))
+	if err := u.SetFile("sampler1", "missing.wav"); err == nil {
+		t.Error("SetFile of a missing file succeeded")
+	}
+	if err := u.SetFile("value2", "hit.wav"); err == nil {
+		t.Error("SetFile of a value succeeded")
+	}
+	check(u.SetFile("sampler1", "hit.wav"))
+	if silent(u.Render(4)) {
+		t.Error("sampler is silent")
+	}
+
+	// The file is saved and loaded with the patch.
+	patch := filepath.Join(dir, "patch")
+	check(u.Save(patch))
+	u = New(nopHandler{})
+	check(u.Load(patch, 0))
+	if file := u.objects["sampler1"].File; file != "hit.wav" {
+		t.Fatalf("loaded sampler's file is %q, want hit.wav", file)
+	}
+	if silent(u.Render(4)) {
+		t.Error("loaded sampler is silent")
+	}
+
+	// A patch whose file is missing isn't loaded, and the old one remains.
+	before := snapshot(t, u)
+	check(os.Rename(filepath.Join(dir, "hit.wav"), filepath.Join(dir, "gone.wav")))
+	if err := u.Load(patch, 0); err == nil {
+		t.Error("Load of patch with missing file succeeded")
+	}
+	check(os.Rename(filepath.Join(dir, "gone.wav"), filepath.Join(dir, "hit.wav")))
+	if got := snapshot(t, u); got != before {
+		t.Errorf("failed Load changed the patch:\ngot  %v\nwant %v", got, before)
+	}
+	if silent(u.Render(4)) {
+		t.Error("sampler is silent after failed Load")
+	}
+
+	// Files are restored by undo.
+	check(u.SetFile("sampler1", ""))
+	check(u.Destroy("sampler1"))
+	check(u.Undo())
+	if file := u.objects["sampler1"].File; file != "" {
+		t.Errorf("file after undoing destroy is %q, want none", file)
+	}
+	check(u.Undo())
+	if file := u.objects["sampler1"].File; file != "hit.wav" {
+		t.Errorf("file after undoing SetFile is %q, want hit.wav", file)
+	}
+}
+
+func TestSteps(t *testing.T) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := New(nopHandler{})
+	check(u.NewObject("sequencer1", "sequencer", 0))
+	check(u.NewObject("value2", "value", 0.5))
+	if n := u.objects["sequencer1"].Steps; n != audio.DefaultSteps {
+		t.Errorf("new sequencer has %v steps, want %v", n, audio.DefaultSteps)
+	}
+	if err := u.Connect("value2", "sequencer1", "v5"); err == nil {
+		t.Error("connected to v5 of a sequencer with 4 steps")
+	}
+	for _, n := range []int{0, audio.MaxSteps + 1} {
+		if err := u.SetSteps("sequencer1", n); err == nil {
+			t.Errorf("SetSteps(%v) succeeded", n)
+		}
+	}
+	if err := u.SetSteps("value2", 8); err == nil {
+		t.Error("SetSteps of a value succeeded")
+	}
+	check(u.SetSteps("sequencer1", 8))
+	check(u.Connect("value2", "sequencer1", "v5"))
+	check(u.Connect("value2", "sequencer1", "v1"))
+
+	// Saved and loaded with the patch.
+	dir, err := ioutil.TempDir("", "sigourney")
+	check(err)
+	defer os.RemoveAll(dir)
+	patch := filepath.Join(dir, "patch")
+	check(u.Save(patch))
+	u2 := New(nopHandler{})
+	check(u2.Load(patch, 0))
+	if got, want := snapshot(t, u2), snapshot(t, u); got != want {
+		t.Errorf("loaded patch\n%v\nwant\n%v", got, want)
+	}
+
+	// Removing steps disconnects their inputs, until undone.
+	before := snapshot(t, u)
+	check(u.SetSteps("sequencer1", 4))
+	if in := u.objects["sequencer1"].Input; in["v5"] != "" || in["v1"] != "value2" {
+		t.Errorf("inputs after removing steps: %v", in)
+	}
+	check(u.Undo())
+	if after := snapshot(t, u); after != before {
+		t.Errorf("after undo\n%v\nwant\n%v", after, before)
+	}
+	u.Render(1)
+}
+
+func TestMaxDelay(t *testing.T) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := New(nopHandler{})
+	check(u.NewObject("delayline1", "delayline", 0))
+	check(u.NewObject("value2", "value", 0.5))
+	if d := u.objects["delayline1"].MaxDelay; d != audio.DefaultMaxDelay {
+		t.Errorf("new delay line's maximum is %v, want %v", d, audio.DefaultMaxDelay)
+	}
+	for _, d := range []float64{0, -1, audio.LongestDelay + 1} {
+		if err := u.SetMaxDelay("delayline1", d); err == nil {
+			t.Errorf("SetMaxDelay(%v) succeeded", d)
+		}
+	}
+	if err := u.SetMaxDelay("value2", 2); err == nil {
+		t.Error("SetMaxDelay of a value succeeded")
+	}
+	check(u.SetMaxDelay("delayline1", 30))
+	u.Render(1)
+
+	// Saved and loaded with the patch, and restored by undo.
+	dir, err := ioutil.TempDir("", "sigourney")
+	check(err)
+	defer os.RemoveAll(dir)
+	patch := filepath.Join(dir, "patch")
+	check(u.Save(patch))
+	u2 := New(nopHandler{})
+	check(u2.Load(patch, 0))
+	if d := u2.objects["delayline1"].MaxDelay; d != 30 {
+		t.Errorf("loaded delay line's maximum is %v, want 30", d)
+	}
+	check(u.Destroy("delayline1"))
+	check(u.Undo())
+	if d := u.objects["delayline1"].MaxDelay; d != 30 {
+		t.Errorf("maximum after undoing destroy is %v, want 30", d)
+	}
+	check(u.Undo())
+	if d := u.objects["delayline1"].MaxDelay; d != audio.DefaultMaxDelay {
+		t.Errorf("maximum after undoing SetMaxDelay is %v, want %v", d, audio.DefaultMaxDelay)
+	}
+}
+
+func TestGroupHistory(t *testing.T) {
+	u := New(nopHandler{})
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var a, b Group
+	as := func(g *Group, f func() error) error {
+		u.SwapGroup(g)
+		defer u.SwapGroup(g)
+		return f()
+	}
+	check(as(&a, func() error { return u.NewObject("sin1", "sin", 0) }))
+	check(as(&b, func() error { return u.NewObject("sin2", "sin", 0) }))
+
+	// Each Group undoes its own changes.
+	check(as(&a, u.Undo))
+	if _, ok := u.objects["sin1"]; ok {
+		t.Error("sin1 remains after a's undo")
+	}
+	if _, ok := u.objects["sin2"]; !ok {
+		t.Error("sin2 removed by a's undo")
+	}
+	if err := as(&a, u.Undo); err == nil {
+		t.Error("a undid another Group's change")
+	}
+
+	// A step that another Group's change keeps from being undone
+	// is dropped, so that the steps before it may be undone.
+	check(as(&a, func() error { return u.NewObject("sin3", "sin", 0) }))
+	check(as(&a, func() error { return u.Connect("sin3", "sin2", "pitch") }))
+	check(as(&b, func() error { return u.Destroy("sin2") }))
+	if err := as(&a, u.Undo); err == nil {
+		t.Error("a undid its connection to sin2, which b destroyed")
+	}
+	check(as(&a, u.Undo))
+	if _, ok := u.objects["sin3"]; ok {
+		t.Error("sin3 remains after a's undo")
+	}
+
+	// Loading a patch clears every Group's history.
+	check(as(&a, func() error { return u.LoadObjects([]*Object{{Name: "engine", Kind: "engine"}}, 0) }))
+	if err := as(&b, u.Undo); err == nil {
+		t.Error("b undid a change made before the load")
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package wav implements encoding and decoding of RIFF/WAVE audio files.
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Format specifies how samples are stored in a WAV file.
+type Format int
+
+const (
+	PCM16   Format = iota // 16-bit signed integer PCM
+	PCM24                 // 24-bit signed integer PCM
+	Float32               // 32-bit IEEE floating point
+)
+
+// ParseFormat parses a Format name as accepted on the command line:
+// "16", "24" or "32f".
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "16":
+		return PCM16, nil
+	case "24":
+		return PCM24, nil
+	case "32f":
+		return Float32, nil
+	}
+	return 0, fmt.Errorf("bad wav format %q; want 16, 24 or 32f", s)
+}
+
+func (f Format) String() string {
+	switch f {
+	case PCM16:
+		return "16"
+	case PCM24:
+		return "24"
+	case Float32:
+		return "32f"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Size returns the number of bytes used to store one sample.
+func (f Format) Size() int {
+	switch f {
+	case PCM16:
+		return 2
+	case PCM24:
+		return 3
+	case Float32:
+		return 4
+	}
+	panic("bad format")
+}
+
+func (f Format) tag() uint16 {
+	if f == Float32 {
+		return 3 // WAVE_FORMAT_IEEE_FLOAT
+	}
+	return 1 // WAVE_FORMAT_PCM
+}
+
+const headerLen = 44
+
+// An Encoder writes samples to a WAV file.
+// The file header is finalized when the Encoder is Closed.
+type Encoder struct {
+	w        io.WriteSeeker
+	f        Format
+	rate     int
+	channels int
+
+	n   int64 // bytes of sample data written
+	buf []byte
+	err error
+}
+
+// NewEncoder writes a WAV header to w and returns an Encoder that appends
+// samples of the given format, sample rate, and number of interleaved
+// channels.
+func NewEncoder(w io.WriteSeeker, f Format, rate, channels int) (*Encoder, error) {
+	if channels < 1 {
+		return nil, errors.New("wav: bad channel count")
+	}
+	f.Size() // Panic early on bad formats.
+	e := &Encoder{w: w, f: f, rate: rate, channels: channels}
+	if err := e.writeHeader(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Encoder) writeHeader() error {
+	size := e.f.Size()
+	h := make([]byte, headerLen)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(headerLen-8+e.n+e.n%2))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], e.f.tag())
+	binary.LittleEndian.PutUint16(h[22:], uint16(e.channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(e.rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(e.rate*e.channels*size))
+	binary.LittleEndian.PutUint16(h[32:], uint16(e.channels*size))
+	binary.LittleEndian.PutUint16(h[34:], uint16(size*8))
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(e.n))
+	_, err := e.w.Write(h)
+	return err
+}
+
+// Write encodes the given interleaved samples.
+// Samples outside the range [-1, 1] are clipped.
+func (e *Encoder) Write(s []float64) error {
+	if e.err != nil {
+		return e.err
+	}
+	b := e.buf[:0]
+	for _, v := range s {
+		b = e.f.Append(b, v)
+	}
+	e.buf = b
+	_, e.err = e.w.Write(b)
+	e.n += int64(len(b))
+	return e.err
+}
+
+// Append appends the encoding of the sample v to b and returns the extended
+// buffer. Values outside the range [-1, 1] are clipped.
+func (f Format) Append(b []byte, v float64) []byte {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	switch f {
+	case PCM16:
+		i := int16(v * math.MaxInt16)
+		return append(b, byte(i), byte(i>>8))
+	case PCM24:
+		i := int32(v * (1<<23 - 1))
+		return append(b, byte(i), byte(i>>8), byte(i>>16))
+	case Float32:
+		i := math.Float32bits(float32(v))
+		return append(b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+	}
+	panic("bad format")
+}
+
+// Close pads the data chunk if necessary and rewrites the header with the
+// final data length. It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.n%2 != 0 {
+		if _, err := e.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if _, err := e.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.err = errors.New("wav: write to closed Encoder")
+	return nil
+}
+
+// Data holds the contents of a WAV file.
+type Data struct {
+	Format   Format
+	Rate     int       // Samples per second, per channel.
+	Channels int       // Number of interleaved channels.
+	Samples  []float64 // Interleaved, in the range [-1, 1].
+}
+
+// Decode reads a WAV file in any of the supported Formats.
+// A data chunk that is cut short, as by a writer that was interrupted,
+// is read up to its end.
+func Decode(r io.Reader) (*Data, error) {
+	var h [12]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, fmt.Errorf("wav: reading header: %v", err)
+	}
+	if string(h[0:4]) != "RIFF" || string(h[8:12]) != "WAVE" {
+		return nil, errors.New("wav: not a RIFF/WAVE file")
+	}
+	le := binary.LittleEndian
+	var d *Data
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(r, ch[:]); err != nil {
+			if err == io.EOF {
+				err = errors.New("no data chunk")
+			}
+			return nil, fmt.Errorf("wav: %v", err)
+		}
+		id, size := string(ch[0:4]), int64(le.Uint32(ch[4:]))
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("wav: short fmt chunk")
+			}
+			if size > 40 {
+				return nil, errors.New("wav: long fmt chunk")
+			}
+			b := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, fmt.Errorf("wav: reading fmt chunk: %v", err)
+			}
+			tag, bits := le.Uint16(b[0:]), le.Uint16(b[14:])
+			if tag == 0xfffe && size >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE: the tag begins the sub-format.
+				tag = le.Uint16(b[24:])
+			}
+			d = &Data{Channels: int(le.Uint16(b[2:])), Rate: int(le.Uint32(b[4:]))}
+			switch {
+			case tag == 1 && bits == 16:
+				d.Format = PCM16
+			case tag == 1 && bits == 24:
+				d.Format = PCM24
+			case tag == 3 && bits == 32:
+				d.Format = Float32
+			default:
+				return nil, fmt.Errorf("wav: unsupported format %v with %v bits", tag, bits)
+			}
+			if d.Channels < 1 || d.Rate < 1 {
+				return nil, errors.New("wav: bad channel count or sample rate")
+			}
+		case "data":
+			if d == nil {
+				return nil, errors.New("wav: data chunk before fmt chunk")
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(r, size))
+			if err != nil {
+				return nil, fmt.Errorf("wav: reading data: %v", err)
+			}
+			n := d.Format.Size()
+			b = b[:len(b)/(n*d.Channels)*n*d.Channels]
+			d.Samples = make([]float64, len(b)/n)
+			for i := range d.Samples {
+				d.Samples[i] = d.Format.decode(b[i*n:])
+			}
+			return d, nil
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+				return nil, fmt.Errorf("wav: skipping %q chunk: %v", id, err)
+			}
+		}
+	}
+}
+
+// decode returns the sample at the start of b.
+func (f Format) decode(b []byte) float64 {
+	switch f {
+	case PCM16:
+		v := float64(int16(uint16(b[0])|uint16(b[1])<<8)) / math.MaxInt16
+		return math.Max(v, -1)
+	case PCM24:
+		i := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		return math.Max(float64(i)/(1<<23-1), -1)
+	case Float32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	panic("bad format")
+}
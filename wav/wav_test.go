@@ -0,0 +1,146 @@
+/*
+Copyright 2015 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	for _, c := range []struct {
+		f    Format
+		tag  uint16
+		data []byte
+	}{
+		{PCM16, 1, []byte{0, 0, 0xff, 0x7f, 0x01, 0x80, 0xff, 0x7f}},
+		{PCM24, 1, []byte{0, 0, 0, 0xff, 0xff, 0x7f, 0x01, 0x00, 0x80, 0xff, 0xff, 0x7f}},
+		{Float32, 3, []byte{0, 0, 0, 0, 0, 0, 0x80, 0x3f, 0, 0, 0x80, 0xbf, 0, 0, 0x80, 0x3f}},
+	} {
+		f, err := ioutil.TempFile("", "sigourney-wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		e, err := NewEncoder(f, c.f, 44100, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write([]float64{0, 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write([]float64{-1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != headerLen+len(c.data) {
+			t.Errorf("%v: len == %v, want %v", c.f, len(b), headerLen+len(c.data))
+			continue
+		}
+		le := binary.LittleEndian
+		if got, want := le.Uint32(b[4:]), uint32(len(b)-8); got != want {
+			t.Errorf("%v: RIFF size == %v, want %v", c.f, got, want)
+		}
+		if got := le.Uint16(b[20:]); got != c.tag {
+			t.Errorf("%v: format tag == %v, want %v", c.f, got, c.tag)
+		}
+		if got := le.Uint16(b[22:]); got != 2 {
+			t.Errorf("%v: channels == %v, want 2", c.f, got)
+		}
+		if got, want := le.Uint16(b[32:]), uint16(2*c.f.Size()); got != want {
+			t.Errorf("%v: block align == %v, want %v", c.f, got, want)
+		}
+		if got := le.Uint32(b[40:]); got != uint32(len(c.data)) {
+			t.Errorf("%v: data size == %v, want %v", c.f, got, len(c.data))
+		}
+		if !bytes.Equal(b[headerLen:], c.data) {
+			t.Errorf("%v: data == % x, want % x", c.f, b[headerLen:], c.data)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	in := []float64{0, 1, -1, 0.5, -0.25, 0.125}
+	for _, f := range []Format{PCM16, PCM24, Float32} {
+		tmp, err := ioutil.TempFile("", "sigourney-wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		e, err := NewEncoder(tmp, f, 22050, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		tmp.Close()
+		b, err := ioutil.ReadFile(tmp.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Insert a chunk of odd length, which should be skipped,
+		// and cut the last sample short.
+		var buf bytes.Buffer
+		buf.Write(b[:36])
+		buf.WriteString("LIST\x03\x00\x00\x00abc\x00")
+		buf.Write(b[36 : len(b)-1])
+
+		d, err := Decode(&buf)
+		if err != nil {
+			t.Errorf("%v: %v", f, err)
+			continue
+		}
+		if d.Format != f || d.Rate != 22050 || d.Channels != 2 {
+			t.Errorf("%v: got format %v, rate %v, channels %v", f, d.Format, d.Rate, d.Channels)
+		}
+		want := in[:4] // The last frame was cut short.
+		if len(d.Samples) != len(want) {
+			t.Errorf("%v: got %v samples, want %v", f, len(d.Samples), len(want))
+			continue
+		}
+		for i, v := range d.Samples {
+			if math.Abs(v-want[i]) > 1e-4 {
+				t.Errorf("%v: sample %v == %v, want %v", f, i, v, want[i])
+			}
+		}
+	}
+
+	if _, err := Decode(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00AVI "))); err == nil {
+		t.Error("Decode of an AVI header succeeded")
+	}
+	if _, err := Decode(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00WAVEfmt \xff\xff\xff\xff"))); err == nil {
+		t.Error("Decode of a huge fmt chunk succeeded")
+	}
+}